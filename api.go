@@ -0,0 +1,244 @@
+package main
+
+//
+// A local control API of the running proxy
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mixcode/https_capture/httpscapture"
+)
+
+var (
+	// control API listen address. empty to disable the API.
+	apiListenAddress = ""
+
+	// bearer token of the control API. generated if empty.
+	apiToken = ""
+)
+
+// check the API address is a loopback address, and prepare the token
+func prepareAPI() (err error) {
+	host, _, err := net.SplitHostPort(apiListenAddress)
+	if err != nil {
+		return
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("the control API must listen on a loopback address: %s", apiListenAddress)
+		}
+	}
+	if apiToken == "" {
+		b := make([]byte, 16)
+		_, err = rand.Read(b)
+		if err != nil {
+			return
+		}
+		apiToken = hex.EncodeToString(b)
+		fmt.Fprintf(os.Stderr, "control API token: %s\n", apiToken)
+	}
+	return
+}
+
+// create the handler of the control API
+func newAPIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sessions", webUISessionList)
+	mux.HandleFunc("/api/sessions/", webUISession)
+	mux.HandleFunc("/api/capture", apiCapture)
+	mux.HandleFunc("/api/rules", apiRules)
+	mux.HandleFunc("/api/rules/", apiRule)
+	mux.HandleFunc("/api/config", apiConfig)
+	mux.HandleFunc("/api/log/rotate", apiRotateLog)
+	mux.HandleFunc("/api/mark", apiMark)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// check the bearer token
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// DELETE /api/capture : clear the session history and the captured files
+func apiCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	proxy.ClearHistory()
+	err := removeBodyFiles(captureDir, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// names of the body files saved by the proxy, e.g. 000001_a_POST.json, 000001_b_index.html
+var bodyFileName = regexp.MustCompile(`^\d{6,}_[ab]_`)
+
+// remove the body files in a capture directory, and in the directories of the routes if withRoutes is set.
+// Logs and other files are left alone.
+func removeBodyFiles(dir string, withRoutes bool) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := filepath.Join(dir, f.Name())
+		if f.IsDir() {
+			if withRoutes {
+				err = removeBodyFiles(name, false)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if f.Type().IsRegular() && bodyFileName.MatchString(f.Name()) {
+			os.Remove(name)
+		}
+	}
+	return nil
+}
+
+// GET /api/rules : list of runtime rules
+// POST /api/rules : add a rule
+func apiRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, proxy.Rules())
+	case http.MethodPost:
+		var rule httpscapture.Rule
+		err := json.NewDecoder(r.Body).Decode(&rule)
+		if err == nil {
+			err = proxy.AddRule(&rule)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, &rule)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DELETE /api/rules/{id} : remove a rule
+func apiRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/rules/"), 10, 64)
+	if err == nil {
+		err = proxy.RemoveRule(id)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runtime configurations
+type apiConfigValues struct {
+	SaveBodies *bool `json:"saveBodies,omitempty"`
+}
+
+// GET /api/config : current configurations
+// PUT /api/config : change configurations
+func apiConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var c apiConfigValues
+		err := json.NewDecoder(r.Body).Decode(&c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if c.SaveBodies != nil {
+			proxy.SetSaveBodies(*c.SaveBodies)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	save := proxy.SaveBodies()
+	writeJSON(w, &apiConfigValues{SaveBodies: &save})
+}
+
+// rotated log files
+type apiRotated struct {
+	Rotated string   `json:"rotated,omitempty"` // the main log
+	Routes  []string `json:"routes,omitempty"`  // the logs of the routes
+}
+
+// POST /api/log/rotate : rotate the log file, and the logs of the routes
+func apiRotateLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var rotated apiRotated
+	var err error
+	if logFileW != nil {
+		rotated.Rotated, err = logFileW.Rotate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	rotated.Routes, err = rotateRouteLogs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rotated.Rotated == "" && rotated.Routes == nil {
+		http.Error(w, "the log is not written to a file", http.StatusConflict)
+		return
+	}
+	writeJSON(w, &rotated)
+}
+
+// POST /api/mark : set a mark on the following sessions
+func apiMark(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var m struct {
+		Name string `json:"name"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	proxy.SetMark(m.Name)
+	logf("%s [mark] %s\n\n", time.Now().Format(time.RFC3339), m.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
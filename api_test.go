@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRemoveBodyFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "lab"), 0755)
+	os.MkdirAll(filepath.Join(dir, "lab", "deep"), 0755)
+	files := map[string]bool{ // name: removed
+		"000001_a_POST.json":       true,
+		"000001_b_index.html":      true,
+		"000001_b_index.utf8.html": true,
+		"1234567_b_data.bin":       true,
+		"lab/000002_b_logo.png":    true,
+		"lab/log.txt":              false,
+		"lab/deep/000003_b_x.bin":  false,
+		"log.txt":                  false,
+		"sessions.jsonl":           false,
+		"notes.txt":                false,
+		"01_b_short.txt":           false,
+		"000004_c_other.txt":       false,
+	}
+	for name := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := removeBodyFiles(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, removed := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if removed != os.IsNotExist(err) {
+			t.Errorf("%s: removed %v", name, os.IsNotExist(err))
+		}
+	}
+}
+
+func TestLogFileRotate(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openLogFile(filepath.Join(dir, "log.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Write([]byte("a"))
+	rotated, err := l.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write([]byte("b"))
+	if b, _ := os.ReadFile(rotated); string(b) != "a" {
+		t.Errorf("rotated log: %q", b)
+	}
+
+	// the log is continued when the rotation fails
+	os.Remove(l.name)
+	if _, err = l.Rotate(); err == nil {
+		t.Errorf("a missing log is rotated")
+	}
+	if _, err = l.Write([]byte("c")); err != nil {
+		t.Errorf("the log is stopped: %v", err)
+	}
+	if b, _ := os.ReadFile(l.name); string(b) != "c" {
+		t.Errorf("log: %q", b)
+	}
+}
+
+func TestRotateRouteLogs(t *testing.T) {
+	defer func() { routeLogs = nil }()
+	dir := t.TempDir()
+	a, err := openRouteLogFile(filepath.Join(dir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := openRouteLogFile(filepath.Join(dir, "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	rotated, err := rotateRouteLogs()
+	if err != nil || len(rotated) != 1 || !strings.HasPrefix(rotated[0], filepath.Join(dir, "a.")) {
+		t.Errorf("rotated %v, %v", rotated, err)
+	}
+}
@@ -0,0 +1,629 @@
+package main
+
+//
+// CA management subcommands: https_capture ca info|export|install|root|issue
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mixcode/https_capture/httpscapture"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// a CA cert warns if it expires in this duration, or in the last quarter of its validity if shorter
+const caExpiryWarning = 30 * 24 * time.Hour
+
+func expiryWarning(cert *x509.Certificate) time.Duration {
+	if d := cert.NotAfter.Sub(cert.NotBefore) / 4; d < caExpiryWarning {
+		return d
+	}
+	return caExpiryWarning
+}
+
+// name of the CA in the trust stores
+const caTrustName = "https_capture"
+
+type caCommand struct {
+	args  string // usage of the arguments
+	help  string
+	run   func(args []string) error
+	flags func(fs *flag.FlagSet) // command specific flags
+}
+
+var caCommands = map[string]*caCommand{
+	"info": {
+		args: "[CERT [KEY]]",
+		help: "show the subject, fingerprints and expiry of a Root CA cert",
+		run:  caInfo,
+	},
+	"export": {
+		args:  "[CERT [KEY]]",
+		help:  "write a Root CA cert in PEM, DER or PKCS#12 to import it to the clients",
+		run:   caExport,
+		flags: caExportFlags,
+	},
+	"install": {
+		args:  "[CERT]",
+		help:  "print the commands to install a Root CA cert to the trust stores",
+		run:   caInstall,
+		flags: caInstallFlags,
+	},
+	"root": {
+		args:  "",
+		help:  "generate a Root CA cert with a new private key, to be kept offline",
+		run:   caRoot,
+		flags: caRootFlags,
+	},
+	"issue": {
+		args:  "ROOT_CERT [ROOT_KEY]",
+		help:  "issue a short-lived intermediate CA from a Root CA, to be used by the proxy in place of the root",
+		run:   caIssue,
+		flags: caIssueFlags,
+	},
+}
+
+// options of the ca subcommands
+var (
+	caBuiltin     = false
+	caFormat      = "pem"
+	caOutput      = "-"
+	caWithKey     = false
+	caP12Password = ""
+	caTarget      = "all"
+	caName        = ""
+	caDays        = 0
+)
+
+// main function 4
+// run a "ca" subcommand
+func runCA(args []string) error {
+	if len(args) == 0 || caCommands[args[0]] == nil {
+		o := flag.CommandLine.Output()
+		names := []string{}
+		for name := range caCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(o, "Usage: %s ca COMMAND [options] ARGS\n\nCommands:\n", os.Args[0])
+		for _, name := range names {
+			fmt.Fprintf(o, "  %-8s %s\n", name, caCommands[name].help)
+		}
+		fmt.Fprintf(o, "\nThe built-in cert is used if -builtin is given. See '%s ca COMMAND -help' for the options.\n", os.Args[0])
+		if len(args) == 0 {
+			return fmt.Errorf("no ca command given")
+		}
+		return fmt.Errorf("unknown ca command: %s", args[0])
+	}
+
+	c := caCommands[args[0]]
+	fs := flag.NewFlagSet("ca "+args[0], flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%s\n\nUsage: %s ca %s [options] %s\n\nOptions:\n", c.help, os.Args[0], args[0], c.args)
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&caBuiltin, "builtin", caBuiltin, "use the built-in default insecure Root CA")
+	fs.BoolVar(&force, "f", force, "force; overwrite existing file")
+	if c.flags != nil {
+		c.flags(fs)
+	}
+	fs.Parse(args[1:])
+	return c.run(fs.Args())
+}
+
+// load the CA cert of a subcommand from the arguments
+func caLoad(args []string) (cert *x509.Certificate, chain []*x509.Certificate, key interface{}, err error) {
+	if caBuiltin {
+		return defaultRootCA, nil, defaultKey, nil
+	}
+	if len(args) == 0 {
+		return nil, nil, nil, fmt.Errorf("no cert file given; give a Root CA cert in PEM, or -builtin")
+	}
+	kf := ""
+	if len(args) > 1 {
+		kf = args[1]
+	}
+	return loadRootCA(args[0], kf)
+}
+
+// the root of a CA chain, to be trusted by the clients
+func trustAnchor(cert *x509.Certificate, chain []*x509.Certificate) *x509.Certificate {
+	if len(chain) > 0 {
+		return chain[len(chain)-1]
+	}
+	return cert
+}
+
+// write the output of a subcommand to caOutput
+func caWriteOutput(b []byte) (err error) {
+	if caOutput == "" || caOutput == "-" {
+		_, err = os.Stdout.Write(b)
+		return
+	}
+	if !promptOverwriteFile(caOutput) {
+		return fmt.Errorf("Aborted")
+	}
+	return os.WriteFile(caOutput, b, 0600)
+}
+
+// the name constraints of a cert
+func constraintNames(c *x509.Certificate) string {
+	l := []string{}
+	for _, d := range c.PermittedDNSDomains {
+		l = append(l, "permitted "+d)
+	}
+	for _, n := range c.PermittedIPRanges {
+		l = append(l, "permitted "+n.String())
+	}
+	for _, d := range c.ExcludedDNSDomains {
+		l = append(l, "excluded "+d)
+	}
+	for _, n := range c.ExcludedIPRanges {
+		l = append(l, "excluded "+n.String())
+	}
+	return strings.Join(l, ", ")
+}
+
+// test whether a cert is made of the built-in insecure key
+func isBuiltinKey(cert *x509.Certificate) bool {
+	return defaultKey.PublicKey.Equal(cert.PublicKey)
+}
+
+// colon separated hex of a hash
+func fingerprint(sum []byte) string {
+	s := make([]string, len(sum))
+	for i, b := range sum {
+		s[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(s, ":")
+}
+
+func keyDescription(pub interface{}) string {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d bits", k.N.BitLen())
+	}
+	return fmt.Sprintf("%T", pub)
+}
+
+//
+// ca info
+//
+
+func caInfo(args []string) error {
+	cert, chain, key, err := caLoad(args)
+	if err != nil {
+		return err
+	}
+	writeCAInfo(os.Stdout, cert, chain, key, time.Now())
+	return nil
+}
+
+// print the summary of a CA cert, with warnings
+func writeCAInfo(w io.Writer, cert *x509.Certificate, chain []*x509.Certificate, key interface{}, now time.Time) {
+	sha1Sum, sha256Sum := sha1.Sum(cert.Raw), sha256.Sum256(cert.Raw)
+	const timeFormat = "2006-01-02 15:04:05 MST"
+
+	fmt.Fprintf(w, "Subject:     %s\n", cert.Subject)
+	fmt.Fprintf(w, "Issuer:      %s\n", cert.Issuer)
+	fmt.Fprintf(w, "Serial:      %s\n", cert.SerialNumber.Text(16))
+	fmt.Fprintf(w, "Not before:  %s\n", cert.NotBefore.UTC().Format(timeFormat))
+	fmt.Fprintf(w, "Not after:   %s (%d days left)\n", cert.NotAfter.UTC().Format(timeFormat), int(cert.NotAfter.Sub(now).Hours()/24))
+	fmt.Fprintf(w, "Public key:  %s\n", keyDescription(cert.PublicKey))
+	fmt.Fprintf(w, "SHA-1:       %s\n", fingerprint(sha1Sum[:]))
+	fmt.Fprintf(w, "SHA-256:     %s\n", fingerprint(sha256Sum[:]))
+	for _, c := range append([]*x509.Certificate{cert}, chain...) {
+		if names := constraintNames(c); names != "" {
+			fmt.Fprintf(w, "Constraint:  %s (%s)\n", names, c.Subject.CommonName)
+		}
+	}
+	for i, c := range chain {
+		fmt.Fprintf(w, "Chain %d:     %s (expires %s)\n", i+1, c.Subject, c.NotAfter.UTC().Format(timeFormat))
+	}
+	switch {
+	case key != nil:
+		fmt.Fprintf(w, "Private key: given\n")
+	case isBuiltinKey(cert):
+		fmt.Fprintf(w, "Private key: the built-in key\n")
+	default:
+		fmt.Fprintf(w, "Private key: not given\n")
+	}
+
+	warn := func(format string, a ...interface{}) {
+		fmt.Fprintf(w, "WARNING: "+format+"\n", a...)
+	}
+	if isBuiltinKey(cert) {
+		warn("the cert is made of the built-in INSECURE key. The key is public, so anyone can make certs trusted by the clients trusting this CA. Install it only on test devices, and remove it after use.")
+	}
+	if !cert.IsCA || cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		warn("the cert is not a CA cert; the clients will not accept certs signed by it.")
+	}
+	if k, ok := key.(interface{ Public() crypto.PublicKey }); ok {
+		if !k.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(cert.PublicKey) {
+			warn("the private key does not match the cert.")
+		}
+	} else if key == nil && !isBuiltinKey(cert) {
+		warn("no private key given; the proxy will sign with the built-in key, which does not match the cert.")
+	}
+	if len(chain) > 0 {
+		opts := x509.VerifyOptions{
+			Roots:         x509.NewCertPool(),
+			Intermediates: x509.NewCertPool(),
+			CurrentTime:   now,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}
+		opts.Roots.AddCert(trustAnchor(cert, chain))
+		for _, c := range chain[:len(chain)-1] {
+			opts.Intermediates.AddCert(c)
+		}
+		if _, err := cert.Verify(opts); err != nil {
+			warn("the chain is not valid: %v", err)
+		}
+	} else if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		warn("the cert is not a Root CA, and its chain is not given; append the chain up to the root to the cert file.")
+	}
+	switch {
+	case now.Before(cert.NotBefore):
+		warn("the cert is not valid yet.")
+	case now.After(cert.NotAfter):
+		warn("the cert has expired.")
+	case now.Add(expiryWarning(cert)).After(cert.NotAfter):
+		warn("the cert expires in %d days.", int(cert.NotAfter.Sub(now).Hours()/24))
+	}
+}
+
+//
+// ca export
+//
+
+func caExportFlags(fs *flag.FlagSet) {
+	fs.StringVar(&caFormat, "format", caFormat, "output format: pem, der (.cer/.crt for Android, iOS and Windows), or p12 (PKCS#12)")
+	fs.StringVar(&caOutput, "o", caOutput, "output file; - for stdout")
+	fs.BoolVar(&caWithKey, "with-key", caWithKey, "also write the private key, to move the CA to another machine or tool. pem and p12 only")
+	fs.StringVar(&caP12Password, "password", caP12Password, "password of the PKCS#12 file")
+}
+
+func caExport(args []string) (err error) {
+	cert, chain, key, err := caLoad(args)
+	if err != nil {
+		return
+	}
+	if caWithKey && key == nil {
+		return fmt.Errorf("no private key given")
+	}
+	if !caWithKey {
+		// the root is installed to the clients
+		cert, chain, key = trustAnchor(cert, chain), nil, nil
+	}
+	var b bytes.Buffer
+	err = exportCA(&b, caFormat, cert, chain, key, caP12Password)
+	if err != nil {
+		return
+	}
+	return caWriteOutput(b.Bytes())
+}
+
+// write a CA cert, and its chain and the key if not nil
+func exportCA(w io.Writer, format string, cert *x509.Certificate, chain []*x509.Certificate, key interface{}, password string) (err error) {
+	var b []byte
+	switch format {
+	case "pem":
+		b = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		for _, c := range chain {
+			b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+		}
+		if key != nil {
+			var kb []byte
+			kb, err = x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				return
+			}
+			b = append(b, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kb})...)
+		}
+	case "der":
+		if key != nil || len(chain) > 0 {
+			return fmt.Errorf("a DER file cannot contain the key or the chain")
+		}
+		b = cert.Raw
+	case "p12":
+		// the legacy encryption is used, since the modern one is not read by older Android, iOS and Windows
+		if key != nil {
+			b, err = pkcs12.LegacyDES.Encode(key, cert, chain, password)
+		} else {
+			b, err = pkcs12.LegacyDES.EncodeTrustStore(append([]*x509.Certificate{cert}, chain...), password)
+		}
+		if err != nil {
+			return
+		}
+	default:
+		return fmt.Errorf("unknown format %s; must be pem, der or p12", format)
+	}
+	_, err = w.Write(b)
+	return
+}
+
+//
+// ca root, ca issue
+//
+
+func caRootFlags(fs *flag.FlagSet) {
+	caName, caDays = "https_capture Root CA", 10*365
+	fs.StringVar(&caName, "cn", caName, "common name of the CA")
+	fs.IntVar(&caDays, "days", caDays, "validity in days")
+	fs.StringVar(&caOutput, "o", caOutput, "output file of the cert and the key in PEM; - for stdout")
+	caConstraintFlags(fs)
+}
+
+func caConstraintFlags(fs *flag.FlagSet) {
+	fs.StringVar(&permittedDNS, "permitted-dns", permittedDNS, "limit the CA to these comma-separated domains and their subdomains (X.509 name constraints)")
+	fs.StringVar(&permittedIP, "permitted-ip", permittedIP, "limit the CA to these comma-separated IP ranges in CIDR. IP addresses are not permitted at all if only -permitted-dns is given, and vice versa")
+}
+
+func caRoot(args []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	nc, err := parseNameConstraints(permittedDNS, permittedIP)
+	if err != nil {
+		return err
+	}
+	cert, err := genCA(key, nil, nil, caName, time.Duration(caDays)*24*time.Hour, nc)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	err = exportCA(&b, "pem", cert, nil, key, "")
+	if err != nil {
+		return err
+	}
+	err = caWriteOutput(b.Bytes())
+	if err == nil && caOutput != "-" {
+		fmt.Fprintf(os.Stderr, "Root CA saved to '%s'. Keep it offline, and issue intermediate CAs for the proxy with '%s ca issue'.\n", caOutput, os.Args[0])
+	}
+	return err
+}
+
+func caIssueFlags(fs *flag.FlagSet) {
+	caName, caDays = "https_capture Intermediate CA", 7
+	fs.StringVar(&caName, "cn", caName, "common name of the intermediate CA")
+	fs.IntVar(&caDays, "days", caDays, "validity in days; limited to the validity of the root")
+	fs.StringVar(&caOutput, "o", caOutput, "output file of the cert, the chain and the key in PEM; - for stdout. The file is used by the proxy in place of the root")
+	caConstraintFlags(fs)
+}
+
+func caIssue(args []string) error {
+	if caBuiltin {
+		return fmt.Errorf("an intermediate CA of the built-in insecure CA is not issued")
+	}
+	root, chain, rootKey, err := caLoad(args)
+	if err != nil {
+		return err
+	}
+	if rootKey == nil {
+		return fmt.Errorf("the private key of the root is not given")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	nc, err := parseNameConstraints(permittedDNS, permittedIP)
+	if err != nil {
+		return err
+	}
+	cert, err := genCA(key, root, rootKey, caName, time.Duration(caDays)*24*time.Hour, nc)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	err = exportCA(&b, "pem", cert, append([]*x509.Certificate{root}, chain...), key, "")
+	if err != nil {
+		return err
+	}
+	err = caWriteOutput(b.Bytes())
+	if err == nil && caOutput != "-" {
+		fmt.Fprintf(os.Stderr, "Intermediate CA saved to '%s', valid until %s. Run the proxy with it in place of the root.\n", caOutput, cert.NotAfter.Local().Format(time.RFC3339))
+	}
+	return err
+}
+
+//
+// ca install
+//
+
+// a trust store
+type trustStore struct {
+	name  string
+	title string
+	write func(w io.Writer, src string, cert *x509.Certificate)
+}
+
+var trustStores = []trustStore{
+	{"debian", "Debian, Ubuntu, Alpine", func(w io.Writer, src string, cert *x509.Certificate) {
+		fmt.Fprintf(w, "  sudo cp %s /usr/local/share/ca-certificates/%s.crt\n", shellQuote(src), caTrustName)
+		fmt.Fprintf(w, "  sudo update-ca-certificates\n")
+		fmt.Fprintf(w, "To remove:\n")
+		fmt.Fprintf(w, "  sudo rm /usr/local/share/ca-certificates/%s.crt && sudo update-ca-certificates --fresh\n", caTrustName)
+	}},
+	{"fedora", "Fedora, RHEL, CentOS", func(w io.Writer, src string, cert *x509.Certificate) {
+		fmt.Fprintf(w, "  sudo cp %s /etc/pki/ca-trust/source/anchors/%s.pem\n", shellQuote(src), caTrustName)
+		fmt.Fprintf(w, "  sudo update-ca-trust\n")
+		fmt.Fprintf(w, "To remove:\n")
+		fmt.Fprintf(w, "  sudo rm /etc/pki/ca-trust/source/anchors/%s.pem && sudo update-ca-trust\n", caTrustName)
+	}},
+	{"suse", "openSUSE, SLES", func(w io.Writer, src string, cert *x509.Certificate) {
+		fmt.Fprintf(w, "  sudo cp %s /etc/pki/trust/anchors/%s.pem\n", shellQuote(src), caTrustName)
+		fmt.Fprintf(w, "  sudo update-ca-certificates\n")
+		fmt.Fprintf(w, "To remove:\n")
+		fmt.Fprintf(w, "  sudo rm /etc/pki/trust/anchors/%s.pem && sudo update-ca-certificates\n", caTrustName)
+	}},
+	{"arch", "Arch Linux", func(w io.Writer, src string, cert *x509.Certificate) {
+		fmt.Fprintf(w, "  sudo trust anchor --store %s\n", shellQuote(src))
+		fmt.Fprintf(w, "To remove:\n")
+		fmt.Fprintf(w, "  sudo trust anchor --remove %s\n", shellQuote(src))
+	}},
+	{"firefox", "Firefox (has its own NSS database per profile; certutil is in libnss3-tools or nss-tools)", func(w io.Writer, src string, cert *x509.Certificate) {
+		profiles := firefoxProfiles()
+		if len(profiles) == 0 {
+			profiles = []string{"PROFILE_DIR"}
+			fmt.Fprintf(w, "  (no profile found; PROFILE_DIR is the directory of cert9.db. see about:support of Firefox)\n")
+		}
+		for _, dir := range profiles {
+			fmt.Fprintf(w, "  certutil -A -d %s -n %s -t C,, -i %s\n", shellQuote("sql:"+dir), caTrustName, shellQuote(src))
+		}
+		fmt.Fprintf(w, "Or, set security.enterprise_roots.enabled to true in about:config to trust the OS store.\n")
+		fmt.Fprintf(w, "To remove:\n")
+		for _, dir := range profiles {
+			fmt.Fprintf(w, "  certutil -D -d %s -n %s\n", shellQuote("sql:"+dir), caTrustName)
+		}
+	}},
+	{"chrome", "Chrome and Chromium on Linux (NSS database of the user)", func(w io.Writer, src string, cert *x509.Certificate) {
+		fmt.Fprintf(w, "  certutil -A -d sql:$HOME/.pki/nssdb -n %s -t C,, -i %s\n", caTrustName, shellQuote(src))
+		fmt.Fprintf(w, "To remove:\n")
+		fmt.Fprintf(w, "  certutil -D -d sql:$HOME/.pki/nssdb -n %s\n", caTrustName)
+	}},
+	{"java", "Java keystore (Java 9 or later; the default password of cacerts is changeit)", func(w io.Writer, src string, cert *x509.Certificate) {
+		fmt.Fprintf(w, "  sudo keytool -importcert -cacerts -storepass changeit -noprompt -alias %s -file %s\n", caTrustName, shellQuote(src))
+		fmt.Fprintf(w, "For Java 8, use -keystore $JAVA_HOME/jre/lib/security/cacerts instead of -cacerts.\n")
+		fmt.Fprintf(w, "To remove:\n")
+		fmt.Fprintf(w, "  sudo keytool -delete -cacerts -storepass changeit -alias %s\n", caTrustName)
+	}},
+	{"macos", "macOS", func(w io.Writer, src string, cert *x509.Certificate) {
+		fmt.Fprintf(w, "  sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain %s\n", shellQuote(src))
+		fmt.Fprintf(w, "To remove:\n")
+		fmt.Fprintf(w, "  sudo security delete-certificate -c %s /Library/Keychains/System.keychain\n", shellQuote(cert.Subject.CommonName))
+	}},
+	{"windows", "Windows (in an administrator command prompt)", func(w io.Writer, src string, cert *x509.Certificate) {
+		fmt.Fprintf(w, "  certutil -addstore -f Root \"%s\"\n", src)
+		fmt.Fprintf(w, "To remove:\n")
+		fmt.Fprintf(w, "  certutil -delstore Root %s\n", cert.SerialNumber.Text(16))
+	}},
+	{"android", "Android", func(w io.Writer, src string, cert *x509.Certificate) {
+		fmt.Fprintf(w, "  Export the cert with 'ca export -format der -o %s.crt', copy it to the device, and install it in\n", caTrustName)
+		fmt.Fprintf(w, "  Settings > Security > Encryption & credentials > Install a certificate > CA certificate.\n")
+		fmt.Fprintf(w, "  Or, open http://%s/ on the device through the proxy.\n", httpscapture.CertPageHost)
+		fmt.Fprintf(w, "  Apps targeting Android 7 or later trust user CAs only if their network security config allows it.\n")
+	}},
+	{"ios", "iOS, iPadOS", func(w io.Writer, src string, cert *x509.Certificate) {
+		fmt.Fprintf(w, "  Export the cert with 'ca export -format der -o %s.cer', send it to the device (e.g. AirDrop or mail), and install the profile in Settings.\n", caTrustName)
+		fmt.Fprintf(w, "  Or, open http://%s/ in Safari through the proxy, and download the profile.\n", httpscapture.CertPageHost)
+		fmt.Fprintf(w, "  Then enable full trust in Settings > General > About > Certificate Trust Settings.\n")
+	}},
+}
+
+func caInstallFlags(fs *flag.FlagSet) {
+	names := []string{}
+	for _, t := range trustStores {
+		names = append(names, t.name)
+	}
+	fs.StringVar(&caTarget, "target", caTarget, "trust store to print: all, "+strings.Join(names, ", "))
+}
+
+func caInstall(args []string) error {
+	cert, chain, key, err := caLoad(args)
+	if err != nil {
+		return err
+	}
+	cert = trustAnchor(cert, chain)
+	src, from := "", "-builtin"
+	if !caBuiltin {
+		from = shellQuote(args[0])
+		if (key == nil || len(args) > 1) && len(chain) == 0 {
+			// a cert file without the key
+			src, err = filepath.Abs(args[0])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return writeCAInstall(os.Stdout, caTarget, src, from, cert)
+}
+
+// print the install commands of a CA cert file src.
+// If src is empty, the cert is to be exported first by 'ca export' with the arguments from.
+func writeCAInstall(w io.Writer, target, src, from string, cert *x509.Certificate) error {
+	found := false
+	for _, t := range trustStores {
+		if target == "all" || target == t.name {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown target %s", target)
+	}
+
+	if isBuiltinKey(cert) {
+		fmt.Fprintf(w, "WARNING: the cert is made of the built-in INSECURE key. Install it only on test devices, and remove it after use.\n\n")
+	}
+	if src == "" {
+		// do not install a file with the private key
+		src = caTrustName + "-ca.pem"
+		if dir, err := os.Getwd(); err == nil {
+			src = filepath.Join(dir, src)
+		}
+		fmt.Fprintf(w, "Export the Root CA cert without the key first:\n  %s ca export -o %s %s\n\n", os.Args[0], shellQuote(src), from)
+	}
+	for _, t := range trustStores {
+		if target == "all" || target == t.name {
+			fmt.Fprintf(w, "# %s\n", t.title)
+			t.write(w, src, cert)
+			fmt.Fprintln(w)
+		}
+	}
+	return nil
+}
+
+// NSS databases of the Firefox profiles of the user
+func firefoxProfiles() (l []string) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	patterns := []string{
+		".mozilla/firefox/*/cert9.db",
+		"snap/firefox/common/.mozilla/firefox/*/cert9.db",
+		".var/app/org.mozilla.firefox/.mozilla/firefox/*/cert9.db",
+	}
+	if runtime.GOOS == "darwin" {
+		patterns = []string{"Library/Application Support/Firefox/Profiles/*/cert9.db"}
+	}
+	for _, p := range patterns {
+		m, _ := filepath.Glob(filepath.Join(home, p))
+		for _, f := range m {
+			l = append(l, filepath.Dir(f))
+		}
+	}
+	return
+}
+
+// quote a string for the shell if needed
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,+@%", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestCAInfo(t *testing.T) {
+	var b bytes.Buffer
+	writeCAInfo(&b, defaultRootCA, nil, defaultKey, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := b.String()
+	if !strings.Contains(s, "SHA-256:     EA:72:8A:C0:") || !strings.Contains(s, "built-in INSECURE key") {
+		t.Errorf("unexpected info:\n%s", s)
+	}
+	if strings.Contains(s, "expire") {
+		t.Errorf("unexpected expiry warning:\n%s", s)
+	}
+
+	// expiring soon
+	b.Reset()
+	writeCAInfo(&b, defaultRootCA, nil, defaultKey, time.Date(2039, 12, 20, 0, 0, 0, 0, time.UTC))
+	if !strings.Contains(b.String(), "the cert expires in 11 days") {
+		t.Errorf("no expiry warning:\n%s", b.String())
+	}
+}
+
+func TestCAExport(t *testing.T) {
+	// PEM with the key is read back as a Root CA
+	var b bytes.Buffer
+	err := exportCA(&b, "pem", defaultRootCA, nil, defaultKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(fn, b.Bytes(), 0600)
+	cert, _, key, err := loadRootCA(fn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Equal(defaultRootCA) || !defaultKey.Equal(key) {
+		t.Errorf("PEM export mismatch")
+	}
+
+	// DER
+	b.Reset()
+	err = exportCA(&b, "der", defaultRootCA, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(b.Bytes())
+	if err != nil || !cert.Equal(defaultRootCA) {
+		t.Errorf("DER export mismatch: %v", err)
+	}
+	if exportCA(&b, "der", defaultRootCA, nil, defaultKey, "") == nil {
+		t.Errorf("DER export with a key must fail")
+	}
+
+	// PKCS#12, with and without the key
+	b.Reset()
+	err = exportCA(&b, "p12", defaultRootCA, nil, nil, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := pkcs12.DecodeTrustStore(b.Bytes(), "pw")
+	if err != nil || len(certs) != 1 || !certs[0].Equal(defaultRootCA) {
+		t.Errorf("PKCS#12 trust store mismatch: %v", err)
+	}
+	b.Reset()
+	err = exportCA(&b, "p12", defaultRootCA, nil, defaultKey, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, cert, _, err = pkcs12.DecodeChain(b.Bytes(), "pw")
+	if err != nil || !cert.Equal(defaultRootCA) || !defaultKey.Equal(key) {
+		t.Errorf("PKCS#12 mismatch: %v", err)
+	}
+
+	if exportCA(&b, "jks", defaultRootCA, nil, nil, "") == nil {
+		t.Errorf("unknown format must fail")
+	}
+}
+
+func TestCAIssue(t *testing.T) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := genCA(rootKey, nil, nil, "test root", 24*time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := genCA(key, root, rootKey, "test intermediate", 7*24*time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.NotAfter.Equal(root.NotAfter) || !ca.MaxPathLenZero {
+		t.Errorf("invalid intermediate: expires %v, MaxPathLenZero %v", ca.NotAfter, ca.MaxPathLenZero)
+	}
+
+	// the intermediate, its chain and the key are read back for the proxy
+	var b bytes.Buffer
+	err = exportCA(&b, "pem", ca, []*x509.Certificate{root}, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "intermediate.pem")
+	os.WriteFile(fn, b.Bytes(), 0600)
+	cert, chain, k, err := loadRootCA(fn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Equal(ca) || len(chain) != 1 || !chain[0].Equal(root) || !key.Equal(k) {
+		t.Errorf("intermediate not read back")
+	}
+
+	b.Reset()
+	writeCAInfo(&b, cert, chain, k, time.Now())
+	if strings.Contains(b.String(), "WARNING") {
+		t.Errorf("unexpected warning:\n%s", b.String())
+	}
+	b.Reset()
+	writeCAInfo(&b, cert, nil, k, time.Now())
+	if !strings.Contains(b.String(), "chain is not given") {
+		t.Errorf("no warning of the missing chain:\n%s", b.String())
+	}
+}
+
+func TestCAInstall(t *testing.T) {
+	var b bytes.Buffer
+	err := writeCAInstall(&b, "debian", "/tmp/my ca.pem", "", defaultRootCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := b.String()
+	if !strings.Contains(s, "sudo cp '/tmp/my ca.pem' /usr/local/share/ca-certificates/https_capture.crt\n") ||
+		strings.Contains(s, "keytool") || strings.Contains(s, "ca export") {
+		t.Errorf("unexpected install commands:\n%s", s)
+	}
+
+	// the cert must be exported without the key
+	b.Reset()
+	err = writeCAInstall(&b, "java", "", "-builtin", defaultRootCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = b.String()
+	if !strings.Contains(s, "ca export -o ") || !strings.Contains(s, "-alias https_capture -file ") {
+		t.Errorf("unexpected install commands:\n%s", s)
+	}
+
+	if writeCAInstall(&b, "plan9", "ca.pem", "", defaultRootCA) == nil {
+		t.Errorf("unknown target must fail")
+	}
+}
+
+func TestPromptOverwriteFile(t *testing.T) {
+	// the given file is checked, not the cert file
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "exists.pem")
+	defer func() { certFile = "" }()
+	os.WriteFile(certFile, []byte{}, 0600)
+	if !promptOverwriteFile(filepath.Join(dir, "new.pem")) {
+		t.Errorf("a new file must not be prompted")
+	}
+}
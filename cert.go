@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -9,8 +10,13 @@ import (
 	"encoding/pem"
 	"fmt"
 	"math/big"
+	"net"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/mixcode/https_capture/httpscapture"
+
 	_ "embed"
 )
 
@@ -107,6 +113,79 @@ func (z zeroReader) Read(p []byte) (n int, err error) {
 // DO NOT USE THE CERT ON REAL WORLD USAGE. THE CERT WILL BE ILLEGIMATE.
 //
 func genRootCA(key *ecdsa.PrivateKey) (cert *x509.Certificate, err error) {
+	return genCA(key, nil, nil, "https_capture dummy Root CA", 10*365*24*time.Hour, nil)
+}
+
+// X.509 name constraints of a generated CA
+type nameConstraints struct {
+	dns []string     // permitted domains and their subdomains
+	ips []*net.IPNet // permitted IP ranges
+}
+
+// Parse comma-separated lists of permitted DNS domains and IP ranges in CIDR. nil if both are empty.
+func parseNameConstraints(dnsList, ipList string) (*nameConstraints, error) {
+	nc := &nameConstraints{}
+	for _, d := range strings.Split(dnsList, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			nc.dns = append(nc.dns, strings.ToLower(d))
+		}
+	}
+	ips, err := parseIPRanges(ipList)
+	if err != nil {
+		return nil, err
+	}
+	nc.ips = ips
+	if len(nc.dns) == 0 && len(nc.ips) == 0 {
+		return nil, nil
+	}
+	return nc, nil
+}
+
+// parse comma-separated IP ranges in CIDR. A single address is a range of itself.
+func parseIPRanges(list string) (ranges []*net.IPNet, err error) {
+	for _, r := range strings.Split(list, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		if !strings.Contains(r, "/") {
+			// a single address
+			if ip := net.ParseIP(r); ip != nil && ip.To4() != nil {
+				r += "/32"
+			} else {
+				r += "/128"
+			}
+		}
+		_, n, e := net.ParseCIDR(r)
+		if e != nil {
+			return nil, e
+		}
+		ranges = append(ranges, n)
+	}
+	return
+}
+
+// set the constraints to a CA template.
+// A kind of names not listed is not permitted at all, or it would be unconstrained.
+func (nc *nameConstraints) apply(template *x509.Certificate) {
+	template.PermittedDNSDomainsCritical = true
+	template.PermittedDNSDomains = nc.dns
+	if len(nc.dns) == 0 {
+		template.PermittedDNSDomains = []string{"invalid"} // a reserved TLD
+	}
+	template.PermittedIPRanges = nc.ips
+	if len(nc.ips) == 0 {
+		template.PermittedIPRanges = []*net.IPNet{
+			{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(32, 32)},
+			{IP: net.IPv6zero, Mask: net.CIDRMask(128, 128)},
+		}
+	}
+}
+
+// Generate a CA cert of the key, signed by the parent CA.
+// A self-signed Root CA is generated if parent is nil.
+// An intermediate CA can sign only leaf certs, and does not outlive the parent.
+// The CA can sign certs only for the names permitted by nc, if not nil.
+func genCA(key *ecdsa.PrivateKey, parent *x509.Certificate, parentKey crypto.PrivateKey, commonName string, validity time.Duration, nc *nameConstraints) (cert *x509.Certificate, err error) {
 
 	serial := makeSerial()
 
@@ -128,7 +207,7 @@ func genRootCA(key *ecdsa.PrivateKey) (cert *x509.Certificate, err error) {
 			PostalCode:         []string{"1-1"},
 
 			SerialNumber: serial.String(),
-			CommonName:   "https_capture dummy Root CA",
+			CommonName:   commonName,
 		},
 		//DNSNames: []string{},
 		//EmailAddresses: []string{},
@@ -136,7 +215,7 @@ func genRootCA(key *ecdsa.PrivateKey) (cert *x509.Certificate, err error) {
 		//URIs: []*uri.URL
 
 		NotBefore: time.Now().Add(-10 * 24 * time.Hour),
-		NotAfter:  time.Now().Add(10 * 365 * 24 * time.Hour),
+		NotAfter:  time.Now().Add(validity),
 
 		KeyUsage:    x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
@@ -146,12 +225,24 @@ func genRootCA(key *ecdsa.PrivateKey) (cert *x509.Certificate, err error) {
 		MaxPathLen:            2,
 		MaxPathLenZero:        false,
 	}
+	if parent == nil {
+		parent, parentKey = template, key
+	} else {
+		template.NotBefore = time.Now().Add(-time.Hour)
+		if template.NotAfter.After(parent.NotAfter) {
+			template.NotAfter = parent.NotAfter
+		}
+		template.MaxPathLen, template.MaxPathLenZero = 0, true
+	}
+	if nc != nil {
+		nc.apply(template)
+	}
 
 	// get pubkey
 	pubKey := key.Public()
 
 	// create cert bytes
-	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, pubKey, key)
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, parent, pubKey, parentKey)
 	if err != nil {
 		return
 	}
@@ -160,6 +251,90 @@ func genRootCA(key *ecdsa.PrivateKey) (cert *x509.Certificate, err error) {
 	return x509.ParseCertificate(certBytes)
 }
 
+// Load a Root CA cert in PEM, and its PKCS#8 private key from keyFile or from the cert file.
+// If the cert is an intermediate CA, the certs following it in the file are its chain up to the root.
+// key is nil if no key is given.
+func loadRootCA(certFile, keyFile string) (cert *x509.Certificate, chain []*x509.Certificate, key interface{}, err error) {
+	pm, err := os.ReadFile(certFile)
+	if err != nil {
+		return
+	}
+	if keyFile != "" {
+		var km []byte
+		km, err = os.ReadFile(keyFile)
+		if err != nil {
+			return
+		}
+		pm = append(append(pm, '\n'), km...)
+	}
+
+	var keyBlock *pem.Block
+	for {
+		var pb *pem.Block
+		pb, pm = pem.Decode(pm)
+		if pb == nil {
+			break
+		}
+		switch {
+		case pb.Type == "CERTIFICATE":
+			var c *x509.Certificate
+			c, err = x509.ParseCertificate(pb.Bytes)
+			if err != nil {
+				return
+			}
+			if cert == nil {
+				cert = c
+			} else {
+				chain = append(chain, c)
+			}
+		case strings.HasSuffix(pb.Type, "PRIVATE KEY") && keyBlock == nil:
+			keyBlock = pb
+		}
+	}
+	if cert == nil {
+		return nil, nil, nil, fmt.Errorf("cert file contains no PEM block")
+	}
+	if keyBlock == nil {
+		if keyFile != "" {
+			return nil, nil, nil, fmt.Errorf("key file contains no PEM block")
+		}
+		return
+	}
+	key, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	return
+}
+
+// Load trusted Root CAs in PEM, in addition to the system roots
+func loadCertPool(filename string) (pool *x509.CertPool, err error) {
+	pm, err := os.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	pool, err = x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+		err = nil
+	}
+	if !pool.AppendCertsFromPEM(pm) {
+		return nil, fmt.Errorf("no certificate found in %s", filename)
+	}
+	return
+}
+
+// Load a client cert in PATTERN=CERT[,KEY]
+func loadClientCert(spec string) (*httpscapture.ClientCert, error) {
+	i := strings.IndexByte(spec, '=')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid client cert %q; must be PATTERN=CERT[,KEY]", spec)
+	}
+	host, files := spec[:i], strings.SplitN(spec[i+1:], ",", 2)
+	keyFile := ""
+	if len(files) > 1 {
+		keyFile = files[1]
+	}
+	return httpscapture.LoadClientCert(host, files[0], keyFile, clientCertPass)
+}
+
 func init() {
 	k, e := x509.ParsePKCS8PrivateKey(defaultKeyDer)
 	if e != nil {
@@ -5,6 +5,7 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"testing"
+	"time"
 )
 
 func TestGenCert(t *testing.T) {
@@ -108,3 +109,29 @@ s4+BHCG5l7nMa6mrOPUYNZQ1/2+bINw9U2Ti8iRIVjPF
 	}
 
 }
+
+func TestNameConstraints(t *testing.T) {
+	nc, err := parseNameConstraints("Example.com, internal.corp", "10.0.0.0/8,192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nc.dns) != 2 || nc.dns[0] != "example.com" || len(nc.ips) != 2 || nc.ips[1].String() != "192.168.1.1/32" {
+		t.Errorf("invalid constraints: %v %v", nc.dns, nc.ips)
+	}
+	if nc, _ := parseNameConstraints("", " "); nc != nil {
+		t.Errorf("constraints from empty lists")
+	}
+	if _, err := parseNameConstraints("", "10.0.0.0/33"); err == nil {
+		t.Errorf("invalid range accepted")
+	}
+
+	// IP addresses are not permitted if only domains are given
+	nc, _ = parseNameConstraints("example.com", "")
+	ca, err := genCA(defaultKey, nil, nil, "test", time.Hour, nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ca.PermittedDNSDomains) != 1 || len(ca.PermittedIPRanges) != 2 || ca.PermittedIPRanges[0].String() != "0.0.0.0/32" {
+		t.Errorf("invalid constraints of the CA: %v %v", ca.PermittedDNSDomains, ca.PermittedIPRanges)
+	}
+}
@@ -1,5 +1,18 @@
 module github.com/mixcode/https_capture
 
-go 1.16
+go 1.22
 
-require github.com/mixcode/goproxy v1.1.2
+require (
+	github.com/andybalholm/brotli v1.0.6
+	github.com/klauspost/compress v1.18.0
+	github.com/mixcode/goproxy v1.1.2
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/crypto v0.33.0
+	golang.org/x/net v0.35.0
+	golang.org/x/term v0.29.0
+	golang.org/x/text v0.22.0
+	google.golang.org/protobuf v1.36.7
+	software.sslmate.com/src/go-pkcs12 v0.5.0
+)
+
+require golang.org/x/sys v0.30.0 // indirect
@@ -0,0 +1,138 @@
+package httpscapture
+
+//
+// Access control of the proxy; client IP ranges and Basic proxy authentication
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	//"github.com/elazarl/goproxy"
+	"github.com/mixcode/goproxy" // a clone of elazarl/goproxy with fixes for TLS SNI
+	"golang.org/x/crypto/bcrypt"
+)
+
+// realm of the proxy authentication
+const authRealm = "https_capture"
+
+// Users of the proxy; passwords by user name.
+// A password is in plain text, or a bcrypt hash as written by 'htpasswd -B'.
+type Users map[string]string
+
+// Load users from a file of "user:password" lines.
+// Empty lines and lines starting with '#' are ignored.
+func LoadUsers(filename string) (u Users, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	u = Users{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: not in user:password form", filename, n)
+		}
+		u[user] = password
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(u) == 0 {
+		return nil, fmt.Errorf("%s: no users", filename)
+	}
+	return
+}
+
+// test the password of a user
+func (u Users) authenticate(user, password string) bool {
+	stored, ok := u[user]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(stored, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// the client of a proxy request
+type clientInfo struct {
+	addr string // IP:port of the client
+	user string // name of the authenticated user. empty if not authenticated.
+}
+
+// context key of the clientInfo of a proxy request
+type clientKey struct{}
+
+// test whether the client IP ranges allow an address
+func (p *Proxy) clientAllowed(addr string) bool {
+	ip := net.ParseIP(hostName(addr))
+	if ip == nil {
+		// not a TCP client; e.g. a unix socket
+		return len(p.opt.AllowClients) == 0
+	}
+	return permittedIP(ip, p.opt.AllowClients, p.opt.DenyClients)
+}
+
+// check the client of a request to the proxy, and pass it to the proxy engine along with the client info
+func (p *Proxy) serveProxy(w http.ResponseWriter, r *http.Request) {
+	if !p.clientAllowed(r.RemoteAddr) {
+		p.printf("DENIED: client[%s] is not allowed\n", r.RemoteAddr)
+		http.Error(w, "forbidden by https_capture", http.StatusForbidden)
+		return
+	}
+
+	c := &clientInfo{addr: r.RemoteAddr}
+	if len(p.opt.Users) > 0 {
+		user, password, ok := proxyBasicAuth(r)
+		if !ok || !p.opt.Users.authenticate(user, password) {
+			if ok {
+				p.printf("AUTH FAILED: client[%s], user[%s]\n", r.RemoteAddr, user)
+			}
+			w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		c.user = user
+	}
+	// the credentials are neither forwarded nor captured
+	r.Header.Del("Proxy-Authorization")
+
+	p.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientKey{}, c)))
+}
+
+// the credentials in Proxy-Authorization
+func proxyBasicAuth(r *http.Request) (user, password string, ok bool) {
+	// parsed as Authorization
+	h := http.Header{"Authorization": r.Header["Proxy-Authorization"]}
+	return (&http.Request{Header: h}).BasicAuth()
+}
+
+// the client of a request; of the CONNECT tunnel, if the request is in one
+func requestClient(req *http.Request, ctx *goproxy.ProxyCtx) *clientInfo {
+	if t, ok := req.Context().Value(tunnelKey{}).(*tunnel); ok {
+		return t.from
+	}
+	if c, ok := req.Context().Value(clientKey{}).(*clientInfo); ok {
+		return c
+	}
+	// a request in a non-TLS CONNECT tunnel
+	c, _ := ctx.UserData.(*clientInfo)
+	return c
+}
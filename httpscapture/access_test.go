@@ -0,0 +1,129 @@
+package httpscapture
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadUsers(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hashed"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "users")
+	err = os.WriteFile(filename, []byte("# proxy users\nalice:secret:with:colons\n\nbob:"+string(hash)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := LoadUsers(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "secret:with:colons", true},
+		{"alice", "secret", false},
+		{"bob", "hashed", true},
+		{"bob", string(hash), false},
+		{"carol", "", false},
+	} {
+		if u.authenticate(c.user, c.password) != c.ok {
+			t.Errorf("%s:%s authenticated %v", c.user, c.password, !c.ok)
+		}
+	}
+
+	os.WriteFile(filename, []byte("alice\n"), 0600)
+	if _, err := LoadUsers(filename); err == nil {
+		t.Errorf("a line without a password accepted")
+	}
+}
+
+func TestProxyAccess(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(backend.Config.Handler)
+	defer tlsBackend.Close()
+
+	sink := &testSink{closed: make(chan *SessionRecord, 4)}
+	p := newTestProxy(t, Options{Sinks: []Sink{sink}, Users: Users{"alice": "secret"}})
+	err := p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	get := func(user *url.Userinfo, target string) int {
+		client := proxyClient(p, true)
+		proxyURL, _ := url.Parse("http://" + p.Addr().String())
+		proxyURL.User = user
+		client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+		resp, err := client.Get(target)
+		if err != nil {
+			if strings.Contains(err.Error(), "Proxy Authentication Required") {
+				return http.StatusProxyAuthRequired // failed CONNECT
+			}
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, target := range []string{backend.URL, tlsBackend.URL} {
+		if status := get(nil, target); status != http.StatusProxyAuthRequired {
+			t.Errorf("%s without credentials: status %d", target, status)
+		}
+		if status := get(url.UserPassword("alice", "wrong"), target); status != http.StatusProxyAuthRequired {
+			t.Errorf("%s with a wrong password: status %d", target, status)
+		}
+		if status := get(url.UserPassword("alice", "secret"), target); status != http.StatusOK {
+			t.Fatalf("%s: status %d", target, status)
+		}
+		rec := <-sink.closed
+		if rec.User != "alice" || !strings.HasPrefix(rec.ClientAddr, "127.0.0.1:") {
+			t.Errorf("%s: invalid client %s, user %q", target, rec.ClientAddr, rec.User)
+		}
+		if rec.ReqHeader.Get("Proxy-Authorization") != "" {
+			t.Errorf("%s: the credentials are captured", target)
+		}
+	}
+
+	// client IP ranges
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	for _, opt := range []Options{
+		{AllowClients: []*net.IPNet{lan}},
+		{AllowClients: []*net.IPNet{loopback}, DenyClients: []*net.IPNet{loopback}},
+	} {
+		p := newTestProxy(t, opt)
+		err := p.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		proxyURL, _ := url.Parse("http://" + p.Addr().String())
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("allow %v, deny %v: status %d", opt.AllowClients, opt.DenyClients, resp.StatusCode)
+		}
+	}
+}
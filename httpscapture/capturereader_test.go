@@ -1,5 +1,4 @@
-//package httpscapture
-package main
+package httpscapture
 
 import (
 	"bytes"
@@ -0,0 +1,172 @@
+package httpscapture
+
+//
+// A page to download the CA cert, served to the proxied clients at a magic host
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	//"github.com/elazarl/goproxy"
+	"github.com/mixcode/goproxy" // a clone of elazarl/goproxy with fixes for TLS SNI
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// The magic host of the CA cert page, e.g. http://https-capture.cert/
+const CertPageHost = "https-capture.cert"
+
+// a download of the CA cert
+type certDownload struct {
+	Path        string
+	Title       string
+	ContentType string
+	QR          template.URL // data URI of the QR code of the download URL
+}
+
+var certDownloads = []*certDownload{
+	{Path: "/ca.pem", Title: "PEM (Linux, Firefox, Java)", ContentType: "application/x-pem-file"},
+	{Path: "/ca.crt", Title: "DER (Android, Windows)", ContentType: "application/x-x509-ca-cert"},
+	{Path: "/ca.mobileconfig", Title: "Configuration profile (iOS, macOS)", ContentType: "application/x-apple-aspen-config"},
+}
+
+var certPageTemplate = template.Must(template.New("certpage").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>https_capture CA certificate</title>
+<style>body{font-family:sans-serif;margin:1em}div.dl{display:inline-block;margin:1em;text-align:center}code{word-break:break-all}</style>
+</head><body>
+<h1>https_capture CA certificate</h1>
+<p>Install this certificate to let the proxy decrypt HTTPS traffic of this device. Install it only on test devices.</p>
+<p>{{.Subject}}<br>SHA-256 <code>{{.SHA256}}</code><br>expires {{.NotAfter}}</p>
+{{range .Downloads}}<div class="dl"><a href="{{.Path}}"><img src="{{.QR}}" alt="QR code" width="200" height="200"><br>{{.Title}}</a></div>
+{{end}}
+<p>On iOS, enable full trust in Settings &gt; General &gt; About &gt; Certificate Trust Settings after installing the profile.</p>
+</body></html>
+`))
+
+// test whether a request is to the CA cert page
+func isCertPage(req *http.Request) bool {
+	return strings.EqualFold(req.URL.Hostname(), CertPageHost)
+}
+
+// the root CA cert to be installed to the clients
+func (p *Proxy) rootCert() *x509.Certificate {
+	if n := len(p.opt.CAChain); n > 0 {
+		return p.opt.CAChain[n-1]
+	}
+	return p.opt.CACert
+}
+
+// answer a request to the CA cert page
+func (p *Proxy) certPage(req *http.Request) *http.Response {
+	cert := p.rootCert()
+	var body []byte
+	contentType := "text/html; charset=utf-8"
+
+	switch req.URL.Path {
+	case "", "/":
+		sum := sha256.Sum256(cert.Raw)
+		data := struct {
+			Subject, SHA256, NotAfter string
+			Downloads                 []*certDownload
+		}{
+			Subject:  cert.Subject.String(),
+			SHA256:   fmt.Sprintf("%X", sum[:]),
+			NotAfter: cert.NotAfter.Format("2006-01-02"),
+		}
+		for _, d := range certDownloads {
+			png, err := qrcode.Encode("http://"+CertPageHost+d.Path, qrcode.Medium, 256)
+			if err != nil {
+				return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusInternalServerError, err.Error())
+			}
+			dl := *d
+			dl.QR = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+			data.Downloads = append(data.Downloads, &dl)
+		}
+		var b bytes.Buffer
+		err := certPageTemplate.Execute(&b, data)
+		if err != nil {
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusInternalServerError, err.Error())
+		}
+		body = b.Bytes()
+	case "/ca.pem":
+		body = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	case "/ca.crt":
+		body = cert.Raw
+	case "/ca.mobileconfig":
+		body = mobileConfig(cert)
+	default:
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusNotFound, "not found\n")
+	}
+	for _, d := range certDownloads {
+		if d.Path == req.URL.Path {
+			contentType = d.ContentType
+		}
+	}
+
+	resp := goproxy.NewResponse(req, contentType, http.StatusOK, string(body))
+	resp.Header.Set("Cache-Control", "no-store")
+	if strings.HasPrefix(req.URL.Path, "/ca.") {
+		resp.Header.Set("Content-Disposition", "attachment; filename=https_capture"+req.URL.Path[len("/ca"):])
+	}
+	return resp
+}
+
+// an Apple configuration profile installing the cert as a trusted root
+func mobileConfig(cert *x509.Certificate) []byte {
+	// the UUIDs are derived from the cert, so the profile of the same cert replaces the old one
+	sum := sha256.Sum256(cert.Raw)
+	uuid := func(b []byte) string {
+		return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	}
+	name := template.HTMLEscapeString(cert.Subject.CommonName)
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>https_capture.cer</string>
+			<key>PayloadContent</key>
+			<data>` + base64.StdEncoding.EncodeToString(cert.Raw) + `</data>
+			<key>PayloadDisplayName</key>
+			<string>` + name + `</string>
+			<key>PayloadIdentifier</key>
+			<string>com.github.mixcode.https-capture.cert.` + uuid(sum[16:]) + `</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>` + uuid(sum[16:]) + `</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>https_capture CA (` + name + `)</string>
+	<key>PayloadDescription</key>
+	<string>Trust the CA of the https_capture proxy. Install it only on test devices.</string>
+	<key>PayloadIdentifier</key>
+	<string>com.github.mixcode.https-capture.` + uuid(sum[:16]) + `</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>` + uuid(sum[:16]) + `</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`)
+}
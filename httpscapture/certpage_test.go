@@ -0,0 +1,65 @@
+package httpscapture
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertPage(t *testing.T) {
+	sink := &testSink{closed: make(chan *SessionRecord, 4)}
+	p := newTestProxy(t, Options{CertPage: true, Sinks: []Sink{sink}})
+	err := p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	client := proxyClient(p, false)
+
+	get := func(path string) (*http.Response, []byte) {
+		resp, err := client.Get("http://" + CertPageHost + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, b
+	}
+
+	resp, b := get("/")
+	if resp.StatusCode != 200 || !strings.Contains(string(b), `href="/ca.mobileconfig"`) || strings.Count(string(b), "data:image/png;base64,") != 3 {
+		t.Errorf("invalid page: %d %s", resp.StatusCode, b)
+	}
+
+	resp, b = get("/ca.crt")
+	if resp.Header.Get("Content-Type") != "application/x-x509-ca-cert" {
+		t.Errorf("invalid content type %s", resp.Header.Get("Content-Type"))
+	}
+	if c, err := x509.ParseCertificate(b); err != nil || !c.Equal(p.opt.CACert) {
+		t.Errorf("invalid DER cert: %v", err)
+	}
+
+	_, b = get("/ca.mobileconfig")
+	if !strings.Contains(string(b), base64.StdEncoding.EncodeToString(p.opt.CACert.Raw)) || !strings.Contains(string(b), "com.apple.security.root") {
+		t.Errorf("invalid profile:\n%s", b)
+	}
+
+	if resp, _ = get("/other"); resp.StatusCode != 404 {
+		t.Errorf("status %d for an unknown path", resp.StatusCode)
+	}
+
+	// the page is not captured
+	select {
+	case rec := <-sink.closed:
+		t.Errorf("the cert page is captured: %s", rec.URL)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
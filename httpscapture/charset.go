@@ -0,0 +1,28 @@
+package httpscapture
+
+//
+// Charset detection and transcoding of text bodies
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+// detect the charset of a text body by BOM, Content-Type param, or HTML meta, and transcode it to UTF-8.
+// Returns the charset name and the UTF-8 text. utf8Text is nil if the body is already in UTF-8.
+func transcodeText(data []byte, contentType string) (charsetName string, utf8Text []byte) {
+	enc, name, certain := charset.DetermineEncoding(data, contentType)
+	if name == "utf-8" || (!certain && utf8.Valid(data)) {
+		// UTF-8, or a guess on a plain ASCII text
+		return "", nil
+	}
+	b, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", nil
+	}
+	return name, b
+}
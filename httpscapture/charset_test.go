@@ -0,0 +1,40 @@
+package httpscapture
+
+import (
+	"testing"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+)
+
+func TestTranscodeText(t *testing.T) {
+	sjis, _ := japanese.ShiftJIS.NewEncoder().Bytes([]byte("日本語"))
+	euckr, _ := korean.EUCKR.NewEncoder().Bytes([]byte("한국어"))
+
+	// charset in Content-Type
+	cs, text := transcodeText(sjis, "text/plain; charset=Shift_JIS")
+	if cs != "shift_jis" || string(text) != "日本語" {
+		t.Errorf("Shift_JIS not transcoded: %s %s", cs, text)
+	}
+
+	// charset in HTML meta
+	html := append([]byte(`<html><head><meta charset="euc-kr"></head><body>`), euckr...)
+	cs, text = transcodeText(html, "text/html")
+	if cs != "euc-kr" || string(text[len(text)-len("한국어"):]) != "한국어" {
+		t.Errorf("EUC-KR not transcoded: %s %s", cs, text)
+	}
+
+	// UTF-8 and ASCII texts are not transcoded
+	for _, s := range []string{"日本語", "plain ascii"} {
+		cs, text = transcodeText([]byte(s), "text/plain")
+		if cs != "" || text != nil {
+			t.Errorf("UTF-8 text transcoded: %s", cs)
+		}
+	}
+
+	// UTF-8 BOM
+	cs, text = transcodeText([]byte("\xef\xbb\xbfabc"), "text/plain; charset=iso-8859-1")
+	if cs != "" || text != nil {
+		t.Errorf("BOM ignored: %s", cs)
+	}
+}
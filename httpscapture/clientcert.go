@@ -0,0 +1,87 @@
+package httpscapture
+
+//
+// Client certs (mutual TLS) presented to the servers
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// A client cert presented to the servers matching Host
+type ClientCert struct {
+	// host name pattern in path.Match syntax, e.g. "*.internal.corp"
+	Host string
+
+	Cert tls.Certificate
+}
+
+// context key of the host name of an upstream request
+type upstreamHostKey struct{}
+
+// Load a client cert for the host pattern.
+// If keyFile is empty, certFile is read as PKCS#12 (.p12, .pfx) with the password,
+// or as a PEM with both the cert chain and the key.
+func LoadClientCert(host, certFile, keyFile, password string) (c *ClientCert, err error) {
+	if _, err = path.Match(host, ""); err != nil {
+		return nil, fmt.Errorf("invalid host pattern %s: %w", host, err)
+	}
+	c = &ClientCert{Host: host}
+	if keyFile != "" {
+		c.Cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+		return
+	}
+
+	ext := strings.ToLower(path.Ext(certFile))
+	if ext == ".p12" || ext == ".pfx" {
+		var b []byte
+		b, err = os.ReadFile(certFile)
+		if err != nil {
+			return
+		}
+		key, cert, chain, e := pkcs12.DecodeChain(b, password)
+		if e != nil {
+			return nil, fmt.Errorf("%s: %w", certFile, e)
+		}
+		c.Cert = tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+		for _, ca := range chain {
+			c.Cert.Certificate = append(c.Cert.Certificate, ca.Raw)
+		}
+		return
+	}
+
+	// a PEM with the key
+	c.Cert, err = tls.LoadX509KeyPair(certFile, certFile)
+	return
+}
+
+// select a client cert for a server's request
+func (p *Proxy) clientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	host, _ := info.Context().Value(upstreamHostKey{}).(string)
+	for _, c := range p.opt.ClientCerts {
+		if ok, _ := path.Match(c.Host, host); ok && info.SupportsCertificate(&c.Cert) == nil {
+			return &c.Cert, nil
+		}
+	}
+	// no cert
+	return &tls.Certificate{}, nil
+}
+
+// summary of the certs from a client
+func peerCertInfo(state *tls.ConnectionState) (l []*CertInfo) {
+	if state == nil {
+		return nil
+	}
+	for _, c := range state.PeerCertificates {
+		l = append(l, newCertInfo(c))
+	}
+	return
+}
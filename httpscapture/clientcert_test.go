@@ -0,0 +1,166 @@
+package httpscapture
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// a self-signed client cert
+func testClientCert(t *testing.T, cn string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestClientCert(t *testing.T) {
+	// a server requiring a client cert
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+
+	cert, key := testClientCert(t, "upstream client")
+	clientCert := tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+
+	for _, host := range []string{"127.0.0.*", "example.com"} {
+		p := newTestProxy(t, Options{ClientCerts: []*ClientCert{{Host: host, Cert: clientCert}}})
+		err := p.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		resp, err := proxyClient(p, false).Get(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if host == "example.com" {
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("client cert used for other hosts")
+			}
+		} else if string(b) != "upstream client" {
+			t.Errorf("client cert not presented: %d %s", resp.StatusCode, b)
+		}
+	}
+}
+
+func TestRequestClientCert(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	sink := &testSink{closed: make(chan *SessionRecord, 4)}
+	p := newTestProxy(t, Options{Sinks: []Sink{sink}, RequestClientCert: true})
+	err := p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	cert, key := testClientCert(t, "downstream client")
+	client := proxyClient(p, true)
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	select {
+	case rec := <-sink.closed:
+		if len(rec.ClientCerts) != 1 || rec.ClientCerts[0].Subject != "CN=downstream client" {
+			t.Errorf("client cert not recorded: %v", rec.ClientCerts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session not closed")
+	}
+}
+
+func TestLoadClientCert(t *testing.T) {
+	cert, key := testClientCert(t, "client")
+	dir := t.TempDir()
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	p12, err := pkcs12.Modern.Encode(key, cert, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"cert.pem": certPem,
+		"key.pem":  keyPem,
+		"both.pem": append(append([]byte{}, certPem...), keyPem...),
+		"cert.p12": p12,
+	}
+	for name, b := range files {
+		err = os.WriteFile(filepath.Join(dir, name), b, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, args := range [][3]string{
+		{"cert.pem", "key.pem", ""},
+		{"both.pem", "", ""},
+		{"cert.p12", "", "secret"},
+	} {
+		key := ""
+		if args[1] != "" {
+			key = filepath.Join(dir, args[1])
+		}
+		c, err := LoadClientCert("*.corp", filepath.Join(dir, args[0]), key, args[2])
+		if err != nil {
+			t.Errorf("%s: %v", args[0], err)
+			continue
+		}
+		if len(c.Cert.Certificate) != 1 || c.Host != "*.corp" {
+			t.Errorf("%s: invalid cert loaded", args[0])
+		}
+	}
+
+	if _, err := LoadClientCert("*.corp", filepath.Join(dir, "cert.p12"), "", "wrong"); err == nil {
+		t.Errorf("wrong password accepted")
+	}
+	if _, err := LoadClientCert("[", filepath.Join(dir, "both.pem"), "", ""); err == nil {
+		t.Errorf("invalid pattern accepted")
+	}
+}
@@ -0,0 +1,99 @@
+package httpscapture
+
+//
+// X.509 name constraints of the CA
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"net"
+	"strings"
+)
+
+// Handling of the hosts outside the name constraints of the CA
+const (
+	ConstraintTunnel = "tunnel" // the connection is tunneled to the server without capturing
+	ConstraintRefuse = "refuse" // the CONNECT request is refused
+)
+
+// test whether the name constraints of the CA and its chain permit a host name or an IP address
+func (s *signer) permits(host string) bool {
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	ip := net.ParseIP(host)
+	for _, c := range s.certs {
+		if ip != nil {
+			if !permittedIP(ip, c.PermittedIPRanges, c.ExcludedIPRanges) {
+				return false
+			}
+		} else if !permittedDNS(host, c.PermittedDNSDomains, c.ExcludedDNSDomains) {
+			return false
+		}
+	}
+	return true
+}
+
+// test whether the signer has name constraints
+func (s *signer) constrained() bool {
+	for _, c := range s.certs {
+		if len(c.PermittedDNSDomains)+len(c.ExcludedDNSDomains)+len(c.PermittedIPRanges)+len(c.ExcludedIPRanges) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func permittedIP(ip net.IP, permitted, excluded []*net.IPNet) bool {
+	for _, n := range excluded {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(permitted) == 0 {
+		return true
+	}
+	for _, n := range permitted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func permittedDNS(host string, permitted, excluded []string) bool {
+	for _, d := range excluded {
+		if matchDomain(host, d) {
+			return false
+		}
+	}
+	if len(permitted) == 0 {
+		return true
+	}
+	for _, d := range permitted {
+		if matchDomain(host, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// match a host to a DNS name constraint of RFC 5280;
+// "example.com" matches the domain and its subdomains, ".example.com" matches the subdomains only
+func matchDomain(host, constraint string) bool {
+	constraint = strings.ToLower(constraint)
+	if constraint == "" {
+		return true
+	}
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(host, constraint)
+	}
+	return host == constraint || strings.HasSuffix(host, "."+constraint)
+}
+
+// the host name of a host:port
+func hostName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
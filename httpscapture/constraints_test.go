@@ -0,0 +1,146 @@
+package httpscapture
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// a Root CA constrained to the DNS names and the IP ranges
+func constrainedCA(t *testing.T, dns []string, ips []*net.IPNet) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:                big.NewInt(1),
+		Subject:                     pkix.Name{CommonName: "https_capture constrained test CA"},
+		NotBefore:                   time.Now().Add(-time.Hour),
+		NotAfter:                    time.Now().Add(time.Hour),
+		KeyUsage:                    x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid:       true,
+		IsCA:                        true,
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         dns,
+		PermittedIPRanges:           ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestNameConstraints(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	ca, key := constrainedCA(t, []string{"example.com", ".internal.corp"}, []*net.IPNet{lan})
+	s, err := newSigner(ca, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.constrained() {
+		t.Errorf("constraints not found")
+	}
+	for host, ok := range map[string]bool{
+		"example.com":        true,
+		"www.Example.com":    true,
+		"badexample.com":     false,
+		"internal.corp":      false,
+		"git.internal.corp":  true,
+		"10.1.2.3":           true,
+		"192.168.0.1":        false,
+		"[::1]":              false,
+		"example.com.evil.x": false,
+	} {
+		if s.permits(host) != ok {
+			t.Errorf("%s: permitted %v, expected %v", host, !ok, ok)
+		}
+	}
+	if _, err := s.sign("example.org", nil); err == nil {
+		t.Errorf("a cert signed outside the constraints")
+	}
+
+	// the leaves are accepted by the clients
+	c, err := s.sign("www.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	if _, err := c.Leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "www.example.com"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProxyOutsideConstraints(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+	backendRoots := x509.NewCertPool()
+	backendRoots.AddCert(backend.Certificate())
+
+	// the backend at 127.0.0.1 is outside the constraints
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	ca, key := constrainedCA(t, []string{"example.com"}, []*net.IPNet{lan})
+	for _, handling := range []string{ConstraintTunnel, ConstraintRefuse} {
+		sink := &testSink{closed: make(chan *SessionRecord, 4)}
+		p, err := New(Options{Addr: "127.0.0.1:0", CACert: ca, CAKey: key, Sinks: []Sink{sink}, OutsideConstraints: handling})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+
+		// the client sees the cert of the server
+		proxyURL, _ := url.Parse("http://" + p.Addr().String())
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: backendRoots},
+		}}
+		resp, err := client.Get(backend.URL)
+		if handling == ConstraintRefuse {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("CONNECT not refused")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "hello" {
+			t.Errorf("invalid tunneled response: %s", b)
+		}
+		select {
+		case <-sink.closed:
+			t.Errorf("a tunneled session is captured")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	if _, err := New(Options{CACert: ca, CAKey: key, OutsideConstraints: "maybe"}); err == nil {
+		t.Errorf("unknown handling accepted")
+	}
+}
@@ -0,0 +1,96 @@
+package httpscapture
+
+//
+// Content-Encoding decoders
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// max size of a decoded body, against decompression bombs.
+// A body decoded larger than this is kept in its raw form.
+var decodedBodyMax int64 = 256 << 20
+
+// list of content codings in a header, in the order they were applied
+func contentEncodings(h http.Header) (list []string) {
+	for _, v := range h.Values("Content-Encoding") {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.ToLower(strings.TrimSpace(s))
+			if s != "" && s != "identity" {
+				list = append(list, s)
+			}
+		}
+	}
+	return
+}
+
+// decode a body encoded with the content codings, in the order they were applied
+func decodeContent(body []byte, encodings []string) (decoded []byte, err error) {
+	decoded = body
+	for i := len(encodings) - 1; i >= 0; i-- {
+		decoded, err = decodeContentOnce(decoded, encodings[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", encodings[i], err)
+		}
+	}
+	return
+}
+
+func decodeContentOnce(body []byte, encoding string) ([]byte, error) {
+	var r io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+
+	case "deflate":
+		// "deflate" is zlib-wrapped, but some servers send raw deflate
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			zr = flate.NewReader(bytes.NewReader(body))
+		}
+		defer zr.Close()
+		r = zr
+
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+
+	default:
+		return nil, fmt.Errorf("unknown content encoding")
+	}
+
+	o := new(bytes.Buffer)
+	_, err := o.ReadFrom(io.LimitReader(r, decodedBodyMax+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(o.Len()) > decodedBodyMax {
+		return nil, fmt.Errorf("decoded body larger than %d bytes", decodedBodyMax)
+	}
+	return o.Bytes(), nil
+}
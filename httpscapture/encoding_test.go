@@ -0,0 +1,104 @@
+package httpscapture
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"net/http"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecodeContent(t *testing.T) {
+	plain := []byte("hello, hello, hello, world")
+
+	encode := map[string]func([]byte) []byte{
+		"gzip": func(b []byte) []byte {
+			var o bytes.Buffer
+			w := gzip.NewWriter(&o)
+			w.Write(b)
+			w.Close()
+			return o.Bytes()
+		},
+		"deflate": func(b []byte) []byte {
+			var o bytes.Buffer
+			w := zlib.NewWriter(&o)
+			w.Write(b)
+			w.Close()
+			return o.Bytes()
+		},
+		"br": func(b []byte) []byte {
+			var o bytes.Buffer
+			w := brotli.NewWriter(&o)
+			w.Write(b)
+			w.Close()
+			return o.Bytes()
+		},
+		"zstd": func(b []byte) []byte {
+			w, _ := zstd.NewWriter(nil)
+			defer w.Close()
+			return w.EncodeAll(b, nil)
+		},
+	}
+
+	for enc, f := range encode {
+		d, err := decodeContent(f(plain), []string{enc})
+		if err != nil {
+			t.Errorf("%s: %v", enc, err)
+		} else if !bytes.Equal(d, plain) {
+			t.Errorf("%s: decoded body mismatch", enc)
+		}
+	}
+
+	// stacked encodings
+	h := http.Header{}
+	h.Add("Content-Encoding", "deflate, identity")
+	h.Add("Content-Encoding", "BR")
+	list := contentEncodings(h)
+	if len(list) != 2 || list[0] != "deflate" || list[1] != "br" {
+		t.Fatalf("invalid encoding list: %v", list)
+	}
+	d, err := decodeContent(encode["br"](encode["deflate"](plain)), list)
+	if err != nil || !bytes.Equal(d, plain) {
+		t.Errorf("stacked encoding not decoded: %v", err)
+	}
+
+	// corrupt stream
+	_, err = decodeContent([]byte("not a gzip stream"), []string{"gzip"})
+	if err == nil {
+		t.Errorf("corrupt stream decoded")
+	}
+
+	// decompression bomb
+	defer func(max int64) { decodedBodyMax = max }(decodedBodyMax)
+	decodedBodyMax = int64(len(plain)) - 1
+	if _, err = decodeContent(encode["gzip"](plain), []string{"gzip"}); err == nil {
+		t.Errorf("a body larger than the limit decoded")
+	}
+}
+
+func TestDecodeBodyFallback(t *testing.T) {
+	p := newTestProxy(t, Options{CaptureDir: "captured", RawBody: true})
+
+	// a corrupt body is kept as is
+	b := &Body{}
+	raw := []byte("not a gzip stream")
+	ok := p.decodeBody(1, b, http.Header{"Content-Encoding": {"gzip"}}, raw)
+	if ok || b.DecodeError == "" || !bytes.Equal(b.Data, raw) {
+		t.Errorf("invalid fallback")
+	}
+
+	// the raw body is kept with the decoded one
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("text"))
+	w.Close()
+	b = &Body{}
+	ok = p.decodeBody(2, b, http.Header{"Content-Encoding": {"gzip"}}, gz.Bytes())
+	p.placeBody(b, ok, "", "000002_b_x.txt")
+	if string(b.Data) != "text" || !bytes.Equal(b.Raw, gz.Bytes()) || b.RawFile != "000002_b_x.txt.gzip" {
+		t.Errorf("raw body not kept: %s", b.RawFile)
+	}
+}
@@ -0,0 +1,75 @@
+package httpscapture
+
+//
+// A sink saving captured bodies to files
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// FileSink saves bodies of closed sessions to files in a directory.
+// Filenames are given by the proxy in Body.File.
+type FileSink struct {
+	Dir         string // directory to save body files
+	RawPostForm bool   // save x-www-form-urlencoded in raw query string
+}
+
+func (s *FileSink) WriteSession(rec *SessionRecord) (err error) {
+	if rec.State != StateClosed {
+		return
+	}
+	for _, b := range []*Body{rec.ReqBody, rec.RespBody} {
+		if b == nil {
+			continue
+		}
+		e := s.writeBody(b)
+		if err == nil {
+			err = e
+		}
+		if b.RawFile != "" {
+			e = os.WriteFile(filepath.Join(s.Dir, b.RawFile), b.Raw, 0644)
+			if err == nil {
+				err = e
+			}
+		}
+		if b.UTF8File != "" {
+			e = os.WriteFile(filepath.Join(s.Dir, b.UTF8File), b.UTF8, 0644)
+			if err == nil {
+				err = e
+			}
+		}
+		for _, part := range b.Parts {
+			if part.File != "" {
+				e = os.WriteFile(filepath.Join(s.Dir, part.File), part.Data, 0644)
+				if err == nil {
+					err = e
+				}
+			}
+		}
+		if b.PrettyFile != "" {
+			e = os.WriteFile(filepath.Join(s.Dir, b.PrettyFile), b.Pretty, 0644)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return
+}
+
+func (s *FileSink) writeBody(b *Body) (err error) {
+	if b.File == "" {
+		return
+	}
+	body := b.Data
+	if b.ContentType == "application/x-www-form-urlencoded" && !s.RawPostForm {
+		// form-urlencoded
+		if lines := formLines(body); lines != nil {
+			body = lines
+		}
+	}
+	return os.WriteFile(filepath.Join(s.Dir, b.File), body, 0644)
+}
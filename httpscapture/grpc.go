@@ -0,0 +1,296 @@
+package httpscapture
+
+//
+// gRPC and gRPC-Web message decoding
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Messages of a gRPC or gRPC-Web body
+type GRPC struct {
+	Method   string         `json:"method,omitempty"` // full method name, e.g. "pkg.Service/Method"
+	Web      bool           `json:"web,omitempty"`    // gRPC-Web
+	Messages []*GRPCMessage `json:"messages"`
+
+	// grpc-status and grpc-message of the response
+	Status  string `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	Trailer http.Header `json:"trailer,omitempty"` // gRPC-Web trailers in the body
+
+	Error string `json:"error,omitempty"` // framing error. messages before the error are kept.
+}
+
+// A length-prefixed message
+type GRPCMessage struct {
+	Compressed bool   `json:"compressed,omitempty"`
+	Size       int    `json:"size"` // size on the wire
+	Data       []byte `json:"-"`    // decompressed message
+	JSON       string `json:"json,omitempty"`
+	Wire       string `json:"wire,omitempty"` // raw wire-format dump, if the message type is unknown
+	Error      string `json:"error,omitempty"`
+}
+
+// Load a FileDescriptorSet, made by `protoc --include_imports --descriptor_set_out=FILE`
+func LoadDescriptorSet(filename string) (files *protoregistry.Files, err error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	var set descriptorpb.FileDescriptorSet
+	err = proto.Unmarshal(b, &set)
+	if err != nil {
+		return
+	}
+	return protodesc.NewFiles(&set)
+}
+
+// test whether a Content-Type is gRPC; returns (isGRPC, isWeb, isWebText)
+func grpcContentType(contentType string) (ok, web, text bool) {
+	mtype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return
+	}
+	base := strings.SplitN(mtype, "+", 2)[0] // application/grpc+proto
+	switch base {
+	case "application/grpc":
+		return true, false, false
+	case "application/grpc-web":
+		return true, true, false
+	case "application/grpc-web-text":
+		return true, true, true
+	}
+	return
+}
+
+// split a gRPC body into messages, and decode them.
+// header is the HTTP header of the body, and trailer is the HTTP trailer of a response (nil for requests).
+func (p *Proxy) decodeGRPC(data []byte, header, trailer http.Header, urlPath string, isRequest bool) *GRPC {
+	ok, web, text := grpcContentType(header.Get("Content-Type"))
+	if !ok {
+		return nil
+	}
+	g := &GRPC{Method: strings.TrimPrefix(urlPath, "/"), Web: web}
+
+	if text {
+		var err error
+		data, err = decodeBase64Chunks(data)
+		if err != nil {
+			g.Error = err.Error()
+			return g
+		}
+	}
+
+	// the message type from the descriptors
+	var msgType protoreflect.MessageDescriptor
+	if p.opt.ProtoFiles != nil {
+		name := protoreflect.FullName(strings.Replace(g.Method, "/", ".", 1))
+		if d, err := p.opt.ProtoFiles.FindDescriptorByName(name); err == nil {
+			if m, ok := d.(protoreflect.MethodDescriptor); ok {
+				if isRequest {
+					msgType = m.Input()
+				} else {
+					msgType = m.Output()
+				}
+			}
+		}
+	}
+
+	encoding := header.Get("Grpc-Encoding")
+	for len(data) > 0 {
+		if len(data) < 5 {
+			g.Error = "truncated message header"
+			break
+		}
+		flag, size := data[0], binary.BigEndian.Uint32(data[1:5])
+		if uint64(size) > uint64(len(data)-5) {
+			g.Error = "truncated message"
+			break
+		}
+		msg := data[5 : 5+size]
+		data = data[5+size:]
+
+		if web && flag&0x80 != 0 {
+			// gRPC-Web trailers in the body
+			r := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(msg), strings.NewReader("\r\n\r\n"))))
+			h, _ := r.ReadMIMEHeader()
+			if g.Trailer == nil {
+				g.Trailer = http.Header{}
+			}
+			for k, v := range h {
+				g.Trailer[k] = v
+			}
+			continue
+		}
+
+		m := &GRPCMessage{Compressed: flag&1 != 0, Size: int(size), Data: msg}
+		if m.Compressed {
+			d, err := decodeContentOnce(msg, strings.ToLower(encoding))
+			if err != nil {
+				m.Error = fmt.Sprintf("decompression failed (%s): %v", encoding, err)
+				g.Messages = append(g.Messages, m)
+				continue
+			}
+			m.Data = d
+		}
+		if msgType != nil {
+			dm := dynamicpb.NewMessage(msgType)
+			err := proto.Unmarshal(m.Data, dm)
+			if err == nil {
+				var j []byte
+				j, err = protojson.Marshal(dm)
+				m.JSON = string(j)
+			}
+			if err != nil {
+				m.Error = err.Error()
+			}
+		}
+		if m.JSON == "" {
+			m.Wire = wireDump(m.Data, "")
+		}
+		g.Messages = append(g.Messages, m)
+	}
+
+	// status of a response. a trailers-only response has the status in the header.
+	if !isRequest {
+		for _, h := range []http.Header{g.Trailer, trailer, header} {
+			if s := h.Get("Grpc-Status"); s != "" && g.Status == "" {
+				g.Status, g.Message = s, h.Get("Grpc-Message")
+			}
+		}
+		if m, err := url.PathUnescape(g.Message); err == nil {
+			// grpc-message is percent-encoded
+			g.Message = m
+		}
+	}
+	return g
+}
+
+// decode a gRPC-Web text body; concatenated base64 chunks, each may be padded
+func decodeBase64Chunks(data []byte) ([]byte, error) {
+	data = bytes.Join(bytes.Fields(data), nil)
+	var out []byte
+	for len(data) > 0 {
+		// a chunk ends after the padding
+		n := len(data)
+		if i := bytes.IndexByte(data, '='); i >= 0 {
+			n = i
+			for n < len(data) && data[n] == '=' {
+				n++
+			}
+		}
+		d, err := base64.StdEncoding.DecodeString(string(data[:n]))
+		if err != nil {
+			d, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(string(data[:n]), "="))
+			if err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, d...)
+		data = data[n:]
+	}
+	return out, nil
+}
+
+// max depth of nested messages in a wire format dump; deeper fields are dumped as bytes
+const wireDumpDepthMax = 32
+
+// dump a protobuf message in wire format, like `protoc --decode_raw`
+func wireDump(data []byte, indent string) string {
+	return wireDumpDepth(data, indent, 0)
+}
+
+func wireDumpDepth(data []byte, indent string, depth int) string {
+	var b strings.Builder
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			fmt.Fprintf(&b, "%s(invalid wire format: % x)\n", indent, data)
+			break
+		}
+		data = data[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				n = len(data)
+			}
+			fmt.Fprintf(&b, "%s%d: %d\n", indent, num, v)
+			data = data[n:]
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(data)
+			if n < 0 {
+				n = len(data)
+			}
+			fmt.Fprintf(&b, "%s%d: 0x%08x\n", indent, num, v)
+			data = data[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(data)
+			if n < 0 {
+				n = len(data)
+			}
+			fmt.Fprintf(&b, "%s%d: 0x%016x\n", indent, num, v)
+			data = data[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				fmt.Fprintf(&b, "%s%d: (truncated)\n", indent, num)
+				data = nil
+				break
+			}
+			data = data[n:]
+			if printable(v) {
+				fmt.Fprintf(&b, "%s%d: %q\n", indent, num, v)
+			} else if depth < wireDumpDepthMax && validWireFormat(v) {
+				// a nested message
+				fmt.Fprintf(&b, "%s%d {\n%s%s}\n", indent, num, wireDumpDepth(v, indent+"  ", depth+1), indent)
+			} else {
+				fmt.Fprintf(&b, "%s%d: % x\n", indent, num, v)
+			}
+		default:
+			// groups are deprecated
+			fmt.Fprintf(&b, "%s(unsupported wire type %d: % x)\n", indent, typ, data)
+			data = nil
+		}
+	}
+	return b.String()
+}
+
+// test whether a field looks like a string
+func printable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package httpscapture
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// a length-prefixed gRPC frame
+func grpcFrame(flag byte, msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	b[0] = flag
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+func TestDecodeGRPC(t *testing.T) {
+	// message test.Req { string name = 1; int32 id = 2; }
+	// service Svc { rpc Call(Req) returns (Req); }
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Req"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("name"), JsonName: proto.String("name"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+				{Name: proto.String("id"), JsonName: proto.String("id"), Number: proto.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+			},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name:   proto.String("Svc"),
+			Method: []*descriptorpb.MethodDescriptorProto{{Name: proto.String("Call"), InputType: proto.String(".test.Req"), OutputType: proto.String(".test.Req")}},
+		}},
+	}
+	files, err := protodesc.NewFiles(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fd}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg []byte
+	msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+	msg = protowire.AppendString(msg, "abc")
+	msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, 7)
+	body := append(grpcFrame(0, msg), grpcFrame(0, msg)...)
+
+	// with descriptors
+	p := newTestProxy(t, Options{ProtoFiles: files})
+	g := p.decodeGRPC(body, http.Header{"Content-Type": {"application/grpc"}}, http.Header{"Grpc-Status": {"3"}, "Grpc-Message": {"bad%20name"}}, "/test.Svc/Call", false)
+	if g == nil || len(g.Messages) != 2 {
+		t.Fatalf("messages not decoded")
+	}
+	if j := strings.ReplaceAll(g.Messages[0].JSON, " ", ""); j != `{"name":"abc","id":7}` {
+		t.Errorf("invalid JSON: %s", g.Messages[0].JSON)
+	}
+	if g.Status != "3" || g.Message != "bad name" {
+		t.Errorf("invalid status: %s %s", g.Status, g.Message)
+	}
+
+	// gRPC-Web text without descriptors, with trailers in the body
+	p = newTestProxy(t, Options{})
+	web := base64.StdEncoding.EncodeToString(grpcFrame(0, msg)) + base64.StdEncoding.EncodeToString(grpcFrame(0x80, []byte("grpc-status: 0\r\ngrpc-message: ok\r\n")))
+	trailer := http.Header{}
+	g = p.decodeGRPC([]byte(web), http.Header{"Content-Type": {"application/grpc-web-text"}}, trailer, "/test.Svc/Call", false)
+	if g == nil || len(g.Messages) != 1 || !g.Web {
+		t.Fatalf("gRPC-Web messages not decoded")
+	}
+	if g.Messages[0].Wire != "1: \"abc\"\n2: 7\n" {
+		t.Errorf("invalid wire dump: %s", g.Messages[0].Wire)
+	}
+	if g.Status != "0" || g.Message != "ok" {
+		t.Errorf("invalid gRPC-Web trailers: %s %s", g.Status, g.Message)
+	}
+	if len(trailer) != 0 || g.Trailer.Get("Grpc-Message") != "ok" {
+		t.Errorf("gRPC-Web trailers are written to the response: %v %v", trailer, g.Trailer)
+	}
+
+	// truncated
+	g = p.decodeGRPC(body[:len(body)-1], http.Header{"Content-Type": {"application/grpc+proto"}}, nil, "/x/y", true)
+	if len(g.Messages) != 1 || g.Error == "" {
+		t.Errorf("truncated body not detected")
+	}
+}
+
+func TestWireDumpDepth(t *testing.T) {
+	msg := protowire.AppendTag(nil, 2, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, 7)
+	for i := 0; i < 100; i++ {
+		msg = protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), msg)
+	}
+	s := wireDump(msg, "")
+	if n := strings.Count(s, "{"); n != wireDumpDepthMax {
+		t.Errorf("%d nested messages dumped", n)
+	}
+}
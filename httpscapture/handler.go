@@ -0,0 +1,555 @@
+package httpscapture
+
+//
+// HTTP request, response, and close handlers
+//
+// If you want to customize the capturing data, you may write a Sink, or modify closeSession() in this file.
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptrace"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	//"github.com/elazarl/goproxy"
+	"github.com/mixcode/goproxy" // a clone of elazarl/goproxy with fixes for TLS SNI
+)
+
+var (
+	contentRangeMatch = regexp.MustCompile(`^([^ ]+) ((\d+)-(\d+)|\*)/(.+)$`)
+)
+
+func (p *Proxy) contentTypeSaveable(contentType string) bool {
+	p.ruleMutex.RLock()
+	defer p.ruleMutex.RUnlock()
+
+	saveContentType, doNotSaveContentType := p.saveContentType, p.doNotSaveContentType
+
+	if len(saveContentType) == 0 && len(doNotSaveContentType) == 0 {
+		return true
+	}
+
+	if len(doNotSaveContentType) == 0 {
+		// do not save files by default. save only in the saveContentType list
+		return saveContentType[contentType]
+	}
+
+	if len(saveContentType) == 0 {
+		// save files by default, but don't save if in doNotSaveContentType list
+		return !doNotSaveContentType[contentType]
+	}
+
+	// both list exists
+	// must contained on saveContentType list but must NOT contained on doNotSaveContentType list
+	return saveContentType[contentType] && !doNotSaveContentType[contentType]
+}
+
+func (p *Proxy) filenameSaveable(filename string) bool {
+	p.ruleMutex.RLock()
+	defer p.ruleMutex.RUnlock()
+
+	saveIfMatch, doNotSaveIfMatch := p.saveIfMatch, p.doNotSaveIfMatch
+
+	if len(saveIfMatch) == 0 && len(doNotSaveIfMatch) == 0 {
+		return true
+	}
+
+	matched := func(rl []*regexp.Regexp) bool {
+		for _, r := range rl {
+			if r.MatchString(filename) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(doNotSaveIfMatch) == 0 {
+		// do not save files by default, save only if name matched against saveIfMatch
+		return matched(saveIfMatch)
+	}
+
+	if len(saveIfMatch) == 0 {
+		//save files by default, do not save if name matched against doNotSaveIfMatch
+		return !matched(doNotSaveIfMatch)
+	}
+
+	// both list exists
+	// must matched against saveIfMatch and NOT matched against doNotSaveIfMatch
+	return matched(saveIfMatch) && !matched(doNotSaveIfMatch)
+}
+
+// A captured HTTP connection
+type Connection struct {
+	Host  string    // host name for HTTP request. maybe empty.
+	Start time.Time // time of the request
+	Mark  string    // the capture mark when the request started
+
+	Req     *http.Request      // HTTP request
+	ReqBody *CaptureReadCloser // HTTP request body stream
+
+	Resp      *http.Response     // HTTP response
+	RespStart time.Time          // time of the response
+	RespBody  *CaptureReadCloser // HTTP response body stream
+
+	RewrittenURL string // the request URL after rewrite rules are applied. empty if not rewritten.
+
+	// trailers, kept when the response body is closed
+	ReqTrailer  http.Header
+	RespTrailer http.Header
+
+	ClientAddr string // IP:port of the client
+	User       string // the proxy user of the client. empty if not authenticated.
+	Tag        string // value of the tag header. empty if not tagged.
+	Route      string // the route of the session. empty if not routed.
+
+	ClientHello *ClientHello // TLS ClientHello of the client. nil if not a MITM TLS tunnel.
+	ClientCerts []*CertInfo  // certs offered by the client, if requested by Options.RequestClientCert
+	ServerAddr  string       // IP:port of the server connected
+	UpstreamTLS *TLSInfo     // TLS parameters of the server connection. nil if not TLS.
+
+	trace *upstreamTrace // events of the upstream round trip
+}
+
+// decide where a body goes; to a file, inline to the log, or nowhere
+func (p *Proxy) placeBody(b *Body, isText bool, route, filename string) {
+	b.IsText = isText
+	if b.Withheld {
+		return
+	}
+	fpath := filepath.Join(p.opt.CaptureDir, route, filename)
+	if atomic.LoadInt32(&p.saveBodies) == 0 || !p.contentTypeSaveable(b.ContentType) || !p.filenameSaveable(fpath) {
+		// contained in do-not-save list
+		return
+	}
+	if p.opt.LogPostInlineAll || (p.opt.LogPostInline && isText) {
+		b.Inline = true
+	} else if p.opt.CaptureDir != "" {
+		b.File = filename
+	}
+	if b.UTF8 != nil && p.opt.SaveUTF8 && p.opt.CaptureDir != "" {
+		b.UTF8File = taggedFilename(filename, "utf8") // e.g. 000001_b_index.utf8.html
+	}
+	if b.Pretty != nil && b.File != "" {
+		b.PrettyFile = taggedFilename(filename, "pretty") // e.g. 000001_b_data.pretty.json
+	}
+	if b.Raw != nil && p.opt.CaptureDir != "" {
+		// e.g. 000001_b_app.js.br
+		b.RawFile = filename + "." + strings.ReplaceAll(b.Encoding, ", ", ".")
+	}
+}
+
+// insert a tag before the file extension
+func taggedFilename(filename, tag string) string {
+	ext := path.Ext(filename)
+	return filename[:len(filename)-len(ext)] + "." + tag + ext
+}
+
+// transcode and format a decoded body
+func (p *Proxy) formatBody(b *Body, isText bool) {
+	if isText {
+		b.Charset, b.UTF8 = transcodeText(b.Data, b.ContentType)
+	}
+	if p.opt.Pretty {
+		b.Pretty = prettyBody(b.Text(), b.Type())
+	}
+}
+
+// set the body data, decoded by Content-Encoding.
+// If the decoding failed, the raw body is used and false is returned.
+func (p *Proxy) decodeBody(sessionId int64, b *Body, header http.Header, raw []byte) bool {
+	b.Data = raw
+	enc := contentEncodings(header)
+	if len(enc) == 0 {
+		return true
+	}
+	b.Encoding = strings.Join(enc, ", ")
+	decoded, err := decodeContent(raw, enc)
+	if err != nil {
+		b.DecodeError = err.Error()
+		p.printf("warning: [%d] content decoding failed (%v); the raw body is kept\n", sessionId, err)
+		return false
+	}
+	b.Data = decoded
+	if p.opt.RawBody {
+		b.Raw = raw
+	}
+	return true
+}
+
+// determine the type of a decoded body by its Content-Type and content.
+// The sniffed type is used if Content-Type is missing or wrong.
+func bodyType(b *Body, sniff bool) (ext string, isText bool) {
+	if sniff {
+		b.SniffedType = sniffContentType(b.Data)
+		b.TypeMismatch = contentTypeMismatch(b.ContentType, b.SniffedType)
+	}
+	t := b.Type()
+	if t == "" {
+		return "", false
+	}
+	_, _, ext, isText, _ = mediaType(t)
+	return
+}
+
+// build the request body of a closed session
+func (p *Proxy) requestBody(sessionId int64, conn *Connection) (b *Body) {
+	b = &Body{}
+	ct := conn.Req.Header["Content-Type"]
+	if len(ct) > 0 {
+		b.ContentType = ct[0]
+	}
+	decoded := p.decodeBody(sessionId, b, conn.Req.Header, conn.ReqBody.Buffer.Bytes())
+	ext, isText := bodyType(b, decoded)
+	isText = isText && decoded
+	if ext == "" {
+		ext = ".bin"
+	}
+	fname := fmt.Sprintf("%06d_a_%s%s", sessionId, conn.Req.Method, ext)
+
+	if decoded {
+		var err error
+		b.Parts, err = parseMultipart(b.Data, b.ContentType)
+		if err != nil {
+			p.printf("warning: [%d] multipart decoding failed (%v)\n", sessionId, err)
+		}
+		b.GRPC = p.decodeGRPC(b.Data, conn.Req.Header, nil, conn.Req.URL.Path, true)
+	}
+	if p.redactor != nil {
+		p.redactor.body(b, decoded)
+	}
+	if decoded {
+		p.formatBody(b, isText)
+	}
+
+	p.placeBody(b, isText, conn.Route, fname)
+
+	// file parts are saved along with the original body
+	if b.File != "" {
+		for _, part := range b.Parts {
+			if !part.IsField {
+				part.File = partFilename(sessionId, part)
+			}
+		}
+	}
+	return
+}
+
+// build the response body of a closed session
+func (p *Proxy) responseBody(sessionId int64, conn *Connection) (b *Body) {
+	b = &Body{}
+
+	// determine file name and type
+	ct := conn.Resp.Header["Content-Type"]
+	if len(ct) > 0 {
+		b.ContentType = ct[0]
+	}
+
+	// detect filename by Content-Disposition
+	outfilename, filename_unknown := "", false
+	if disp, ok := conn.Resp.Header["Content-Disposition"]; ok {
+		_, param, _ := mime.ParseMediaType(disp[0])
+		outfilename = param["filename"]
+	}
+	// detect filename by URL path
+	if outfilename == "" {
+		_, outfilename = path.Split(conn.Req.URL.EscapedPath())
+	}
+	if outfilename == "" {
+		// cannot determine filename
+		filename_unknown = true
+		outfilename = "unknown"
+	}
+
+	// decode the body and determine its type. a partial content may not have its magic number.
+	decoded := p.decodeBody(sessionId, b, conn.Resp.Header, conn.RespBody.Buffer.Bytes())
+	typeExt, isText := bodyType(b, decoded && conn.Resp.StatusCode != 206)
+	isText = isText && decoded
+	if decoded {
+		b.GRPC = p.decodeGRPC(b.Data, conn.Resp.Header, conn.Resp.Trailer, conn.Req.URL.Path, false)
+	}
+
+	// determine file extension
+	ext := path.Ext(outfilename)
+	filenameBody := outfilename[:len(outfilename)-len(ext)]
+	if ext == "" {
+		ext = typeExt
+	}
+	if ext == "" {
+		// unknown file type
+		ext = ".bin"
+	}
+
+	if filename_unknown && ext == ".html" {
+		outfilename = "index"
+	} else {
+		outfilename = filenameBody
+	}
+
+	outfilename = fmt.Sprintf("%06d_b_%s", sessionId, outfilename)
+
+	// trim if the filename is too long
+	shortname := outfilename
+	if len(shortname) > filenameMaxLen {
+		shortname = shortname[:filenameMaxLen]
+	}
+
+	if conn.Resp.StatusCode == 206 { // 206 partial contents
+		// Add content offset and size if the data is 206 partial content
+		shortname += func() string {
+			r := conn.Resp.Header["Content-Range"]
+			if len(r) == 0 {
+				return ""
+			}
+			start, _, total, e := contentRange(r[0])
+			if e != nil {
+				return ""
+			}
+			actualEnd := start + conn.RespBody.Size
+			if actualEnd == 0 {
+				return ""
+			}
+			if total > 0 && start == 0 && actualEnd == total {
+				// Full content has received
+				return ""
+			}
+			s := fmt.Sprintf("%d-%d", start, actualEnd-1)
+			if total > 0 {
+				s = fmt.Sprintf("%s(%d)", s, total)
+			}
+			return "[partial_" + s + "]"
+		}()
+	}
+	shortname = shortname + ext
+
+	if p.redactor != nil {
+		p.redactor.body(b, decoded)
+	}
+	if decoded {
+		p.formatBody(b, isText)
+	}
+
+	p.placeBody(b, isText, conn.Route, shortname)
+	return
+}
+
+// HTTP connection closed; send the result to the sink
+func (p *Proxy) closeSession(sessionId int64, conn *Connection, inErr error) (err error) {
+
+	//
+	// This function is called when a HTTP(s) connection has closed.
+	// conn contains complete history of a connection
+	//
+
+	rec := newSessionRecord(sessionId, conn)
+	rec.End = time.Now()
+	rec.Timings = conn.trace.timings(rec.End)
+
+	if inErr != nil {
+		// HTTP error happened
+		rec.State, rec.Error = StateFailed, inErr.Error()
+	} else {
+		rec.State = StateClosed
+
+		// the request body
+		if conn.ReqBody != nil && conn.ReqBody.Size > 0 {
+			rec.ReqBody = p.requestBody(sessionId, conn)
+		}
+
+		// the response body
+		if conn.RespBody.Size > 0 {
+			rec.RespBody = p.responseBody(sessionId, conn)
+		}
+	}
+
+	p.publish(rec)
+	return
+}
+
+// make a callback function called when the response body is closed
+func (p *Proxy) makeHttpRespCloseCallback(sessionId int64, conn *Connection) func(error) {
+	// actual callback function for proxy engine
+	return func(inErr error) {
+		// remove the current session from the buffer
+		p.sessionMutex.Lock()
+		s, ok := p.session[sessionId]
+		if !ok || s != conn {
+			p.sessionMutex.Unlock()
+			return
+		}
+		delete(p.session, sessionId)
+		p.sessionMutex.Unlock()
+
+		// trailers are read along with the end of the bodies
+		conn.ReqTrailer, conn.RespTrailer = trailerValues(conn.Req.Trailer), trailerValues(conn.Resp.Trailer)
+
+		// call handler main
+		err := p.closeSession(sessionId, conn, inErr)
+		if err != nil {
+			p.reportError(err)
+		}
+	}
+}
+
+// record the start of a HTTP request
+func (p *Proxy) reqHandler(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+
+	if p.opt.CertPage && isCertPage(req) {
+		// not a session; answered by ourselves
+		return req, p.certPage(req)
+	}
+
+	// goproxy shares a session number among the requests in a CONNECT tunnel; number them by ourselves
+	sessionId := atomic.AddInt64(&p.lastSessionId, 1)
+	conn := Connection{Host: ctx.Host, Start: time.Now(), Mark: p.currentMark(), Req: req}
+	if c := requestClient(req, ctx); c != nil {
+		conn.ClientAddr, conn.User = c.addr, c.user
+	}
+	if h := p.opt.TagHeader; h != "" {
+		// the tag is recorded apart from the headers
+		conn.Tag = req.Header.Get(h)
+		req.Header.Del(h)
+	}
+	conn.Route = p.route(&conn)
+	ctx.UserData = sessionId
+	if t, ok := req.Context().Value(tunnelKey{}).(*tunnel); ok {
+		conn.ClientHello = t.client.clientHello()
+		conn.ClientCerts = peerCertInfo(req.TLS)
+	}
+
+	if p.requestBlocked(req) {
+		rec := newSessionRecord(sessionId, &conn)
+		rec.State = StateBlocked
+		p.publish(rec)
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "blocked by https_capture\n")
+	}
+
+	// trace the upstream round trip
+	conn.trace = &upstreamTrace{}
+	newReq := req.Clone(httptrace.WithClientTrace(context.Background(), conn.trace.clientTrace()))
+
+	newURL, e := p.rewriteURL(req.URL)
+	if e != nil {
+		p.printf("rewrite failed (%v) %s %s\n", e, req.Method, req.URL.String())
+	} else if newURL != nil {
+		newReq.URL = newURL
+		newReq.Host = newURL.Host
+		conn.RewrittenURL = newURL.String()
+	}
+	// to select a client cert for the server
+	newReq = newReq.WithContext(context.WithValue(newReq.Context(), upstreamHostKey{}, newReq.URL.Hostname()))
+
+	if req.Body != nil {
+		conn.ReqBody = NewCaptureReadCloser(req.Body)
+		newReq.Body = conn.ReqBody
+	}
+
+	p.sessionMutex.Lock()
+	p.session[sessionId] = &conn
+	p.sessionMutex.Unlock()
+
+	p.publish(newSessionRecord(sessionId, &conn))
+	return newReq, nil
+}
+
+// record a HTTP response
+func (p *Proxy) respHandler(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	sessionId, ok := ctx.UserData.(int64)
+	if !ok {
+		return resp
+	}
+	p.sessionMutex.Lock()
+	conn := p.session[sessionId]
+	if conn != nil && resp == nil {
+		// the request failed
+		delete(p.session, sessionId)
+	}
+	p.sessionMutex.Unlock()
+	if conn == nil {
+		return resp
+	}
+
+	if resp == nil {
+		err := ctx.Error
+		if err == nil {
+			err = fmt.Errorf("no response")
+		}
+		p.closeSession(sessionId, conn, err)
+		return resp
+	}
+
+	conn.Resp, conn.RespStart = resp, time.Now()
+	conn.ServerAddr, conn.UpstreamTLS = conn.trace.serverAddr(), newTLSInfo(resp.TLS)
+	if conn.UpstreamTLS != nil && p.opt.UpstreamVerify != VerifyInsecure {
+		host := conn.Req.URL.Hostname()
+		if resp.Request != nil {
+			host = resp.Request.URL.Hostname() // maybe rewritten
+		}
+		if err := p.verifyUpstream(resp.TLS, host); err != nil {
+			conn.UpstreamTLS.VerifyError = err.Error()
+			p.printf("warning: [%d] the server certificate of %s is not valid (%v)\n", sessionId, host, err)
+		}
+	}
+	if resp.Body != nil {
+		p.publish(newSessionRecord(sessionId, conn))
+		conn.RespBody = NewCaptureReadCloserCallback(resp.Body, p.makeHttpRespCloseCallback(sessionId, conn))
+		resp.Body = conn.RespBody
+	}
+	return resp
+}
+
+// trailers with values. a declared trailer may not be sent at all.
+func trailerValues(trailer http.Header) http.Header {
+	var h http.Header
+	for k, v := range trailer {
+		if len(v) > 0 {
+			if h == nil {
+				h = http.Header{}
+			}
+			h[k] = append([]string(nil), v...)
+		}
+	}
+	return h
+}
+
+func contentRange(contentRangeString string) (start, end, total int64, err error) {
+	m := contentRangeMatch.FindStringSubmatch(contentRangeString)
+	if m[1] != "bytes" {
+		err = fmt.Errorf("content range unknown unit: %s", m[1])
+		return
+	}
+	rStart, rEnd := m[3], m[4]
+	if rStart == "" {
+		rStart = "0"
+	}
+	if rEnd == "" {
+		rEnd = rStart
+	}
+	rStartPos, e := strconv.ParseInt(rStart, 10, 64)
+	if e != nil {
+		err = fmt.Errorf("content range parse error: %s", rStart)
+		return
+	}
+	rEndPos, e := strconv.ParseInt(rEnd, 10, 64)
+	if e != nil {
+		err = fmt.Errorf("content range parse error: %s", rEnd)
+		return
+	}
+	start, end = rStartPos, rEndPos
+
+	rSize := m[5]
+	if rSize != "*" {
+		total, err = strconv.ParseInt(rSize, 10, 64)
+	}
+	return
+}
@@ -0,0 +1,294 @@
+package httpscapture
+
+//
+// A sink writing sessions in HAR (HTTP Archive) format
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HARSink collects finished sessions, and writes them to W as a HAR 1.2 document when closed.
+// All sessions are kept in memory until the sink is closed.
+type HARSink struct {
+	W io.Writer
+
+	mutex   sync.Mutex
+	entries []*harEntry
+	closed  bool
+}
+
+type harLog struct {
+	Log struct {
+		Version string      `json:"version"`
+		Creator harCreator  `json:"creator"`
+		Entries []*harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	id int64
+
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+	Error           string      `json:"_error,omitempty"`
+
+	ClientAddr  string       `json:"_clientAddr,omitempty"`
+	User        string       `json:"_user,omitempty"`
+	Tag         string       `json:"_tag,omitempty"`
+	Route       string       `json:"_route,omitempty"`
+	TLS         *TLSInfo     `json:"_tls,omitempty"`
+	ClientHello *ClientHello `json:"_clientHello,omitempty"`
+	ClientCerts []*CertInfo  `json:"_clientCerts,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	Trailers    []harNameValue `json:"_trailers,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	Trailers    []harNameValue `json:"_trailers,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string     `json:"mimeType"`
+	Params   []harParam `json:"params,omitempty"`
+	Text     string     `json:"text"`
+	Encoding string     `json:"_encoding,omitempty"`
+}
+
+type harParam struct {
+	Name        string `json:"name"`
+	Value       string `json:"value,omitempty"`
+	FileName    string `json:"fileName,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func (s *HARSink) WriteSession(rec *SessionRecord) (err error) {
+	if rec.State == StateRequest || rec.State == StateResponse {
+		return
+	}
+	e := newHAREntry(rec)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		s.entries = append(s.entries, e)
+	}
+	return
+}
+
+// Write the collected sessions to W
+func (s *HARSink) Close() (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].id < s.entries[j].id })
+	var h harLog
+	h.Log.Version = "1.2"
+	h.Log.Creator = harCreator{Name: "https_capture", Version: "1"}
+	h.Log.Entries = s.entries
+	if h.Log.Entries == nil {
+		h.Log.Entries = []*harEntry{}
+	}
+	enc := json.NewEncoder(s.W)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&h)
+}
+
+func newHAREntry(rec *SessionRecord) *harEntry {
+	e := &harEntry{
+		id:              rec.Id,
+		StartedDateTime: rec.Start,
+		Comment:         rec.Mark,
+		Error:           rec.Error,
+	}
+	if rec.State == StateBlocked {
+		e.Error = "blocked"
+	}
+	if host, _, err := net.SplitHostPort(rec.ServerAddr); err == nil {
+		e.ServerIPAddress = host
+	}
+	e.TLS, e.ClientHello, e.ClientCerts = rec.UpstreamTLS, rec.ClientHello, rec.ClientCerts
+	e.ClientAddr, e.User, e.Tag, e.Route = rec.ClientAddr, rec.User, rec.Tag, rec.Route
+
+	// timings in milliseconds
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	// -1 for the steps not taken
+	optional := func(d time.Duration) float64 {
+		if d <= 0 {
+			return -1
+		}
+		return ms(d)
+	}
+	e.Timings.Blocked, e.Timings.DNS, e.Timings.Connect, e.Timings.SSL = -1, -1, -1, -1
+	if t := rec.Timings; t != nil {
+		e.Time = ms(rec.End.Sub(rec.Start))
+		e.Timings.Blocked, e.Timings.DNS, e.Timings.SSL = optional(t.Blocked), optional(t.DNS), optional(t.TLS)
+		e.Timings.Connect = optional(t.Connect + t.TLS) // connect includes ssl in HAR
+		e.Timings.Send, e.Timings.Wait, e.Timings.Receive = ms(t.Send), ms(t.Wait), ms(t.Receive)
+	} else if !rec.End.IsZero() {
+		e.Time = ms(rec.End.Sub(rec.Start))
+		e.Timings.Wait = e.Time
+		if !rec.RespStart.IsZero() {
+			e.Timings.Wait = ms(rec.RespStart.Sub(rec.Start))
+			e.Timings.Receive = ms(rec.End.Sub(rec.RespStart))
+		}
+	}
+
+	// request
+	req := &e.Request
+	req.Method, req.URL, req.HTTPVersion = rec.Method, rec.URL, harVersion(rec.Proto)
+	req.Headers = harHeaders(rec.ReqHeader)
+	if len(rec.ReqTrailer) > 0 {
+		req.Trailers = harHeaders(rec.ReqTrailer)
+	}
+	req.Cookies = harCookies((&http.Request{Header: rec.ReqHeader}).Cookies())
+	req.QueryString = []harNameValue{}
+	if u, err := url.Parse(rec.URL); err == nil {
+		req.QueryString = harValues(u.Query())
+	}
+	req.HeadersSize, req.BodySize = -1, rec.ReqSize
+	if b := rec.ReqBody; b != nil {
+		req.PostData = &harPostData{MimeType: b.ContentType}
+		req.PostData.Text, req.PostData.Encoding = harText(b.Text())
+		for _, part := range b.Parts {
+			param := harParam{Name: part.Name, FileName: part.FileName, ContentType: part.ContentType}
+			if part.IsField {
+				param.Value = string(part.Data)
+			}
+			req.PostData.Params = append(req.PostData.Params, param)
+		}
+	}
+
+	// response
+	resp := &e.Response
+	resp.HTTPVersion = harVersion(rec.UpstreamProto)
+	resp.Status = rec.StatusCode
+	if i := strings.IndexByte(rec.Status, ' '); i >= 0 {
+		resp.StatusText = rec.Status[i+1:] // "200 OK" -> "OK"
+	}
+	resp.Headers = harHeaders(rec.RespHeader)
+	if len(rec.RespTrailer) > 0 {
+		resp.Trailers = harHeaders(rec.RespTrailer)
+	}
+	resp.Cookies = harCookies((&http.Response{Header: rec.RespHeader}).Cookies())
+	resp.RedirectURL = rec.RespHeader.Get("Location")
+	resp.HeadersSize, resp.BodySize = -1, rec.RespSize
+	resp.Content.MimeType = rec.RespContentType
+	if b := rec.RespBody; b != nil {
+		resp.Content.Size = int64(len(b.Data))
+		resp.Content.Text, resp.Content.Encoding = harText(b.Text())
+	}
+	return e
+}
+
+// a body as a text, or in base64 if not a valid UTF-8
+func harText(b []byte) (text, encoding string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	l := []harNameValue{}
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			l = append(l, harNameValue{k, v})
+		}
+	}
+	return l
+}
+
+func harValues(v url.Values) []harNameValue {
+	return harHeaders(http.Header(v))
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	l := []harNameValue{}
+	for _, c := range cookies {
+		l = append(l, harNameValue{c.Name, c.Value})
+	}
+	return l
+}
+
+// the protocol version; HTTP/1.1 if unknown
+func harVersion(proto string) string {
+	if proto == "" {
+		return "HTTP/1.1"
+	}
+	return proto
+}
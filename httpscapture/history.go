@@ -0,0 +1,270 @@
+package httpscapture
+
+//
+// Session records, and in-memory history of HTTP sessions for the live viewers
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// session states
+const (
+	StateRequest  = "request"  // request received, waiting for the response
+	StateResponse = "response" // response headers received, body is being transferred
+	StateClosed   = "closed"   // the response body is closed
+	StateFailed   = "failed"   // the connection failed
+	StateBlocked  = "blocked"  // the request is blocked by a rule
+)
+
+// A snapshot of a HTTP session, built from a Connection
+type SessionRecord struct {
+	Id    int64     `json:"id"`
+	State string    `json:"state"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end,omitempty"`
+
+	RespStart time.Time `json:"respStart,omitempty"` // time of the response headers
+
+	Timings *Timings `json:"timings,omitempty"` // breakdown of the upstream round trip, set when the session is finished
+
+	Method string `json:"method"`
+	Host   string `json:"host"`
+	URL    string `json:"url"`
+	Path   string `json:"path"`
+
+	RewrittenURL string `json:"rewrittenUrl,omitempty"` // the URL actually requested, if rewritten by a rule
+
+	Proto         string `json:"proto,omitempty"`         // protocol of the client request, e.g. "HTTP/2.0"
+	UpstreamProto string `json:"upstreamProto,omitempty"` // protocol of the response from the server
+
+	Mark string `json:"mark,omitempty"` // the capture mark when the session started
+
+	Status     string `json:"status,omitempty"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	ClientAddr string `json:"clientAddr,omitempty"` // IP:port of the client
+	User       string `json:"user,omitempty"`       // the proxy user of the client
+	Tag        string `json:"tag,omitempty"`        // value of the tag header
+	Route      string `json:"route,omitempty"`      // the route of the session
+
+	ClientHello *ClientHello `json:"clientHello,omitempty"` // TLS ClientHello of the client
+	ClientCerts []*CertInfo  `json:"clientCerts,omitempty"` // certs offered by the client
+	ServerAddr  string       `json:"serverAddr,omitempty"`  // IP:port of the server connected
+	UpstreamTLS *TLSInfo     `json:"upstreamTls,omitempty"` // TLS parameters of the server connection
+
+	ReqHeader  http.Header `json:"reqHeader,omitempty"`
+	RespHeader http.Header `json:"respHeader,omitempty"`
+
+	// trailers are set when the session is closed
+	ReqTrailer  http.Header `json:"reqTrailer,omitempty"`
+	RespTrailer http.Header `json:"respTrailer,omitempty"`
+
+	ReqSize  int64 `json:"reqSize"`  // size of the request body on the wire
+	RespSize int64 `json:"respSize"` // size of the response body on the wire
+
+	ReqContentType  string `json:"reqContentType,omitempty"`
+	RespContentType string `json:"respContentType,omitempty"`
+
+	// bodies are set when the session is closed
+	ReqBody  *Body `json:"reqBody,omitempty"`
+	RespBody *Body `json:"respBody,omitempty"`
+}
+
+// A HTTP body of a closed session
+type Body struct {
+	Data        []byte `json:"-"`                     // decoded body
+	ContentType string `json:"contentType,omitempty"` // Content-Type of the body
+	IsText      bool   `json:"isText"`                // the body is known as a text
+	File        string `json:"file,omitempty"`        // filename to be saved in the capture directory. empty if not saved.
+	Inline      bool   `json:"inline,omitempty"`      // the body is to be written inline to the log
+	Withheld    bool   `json:"withheld,omitempty"`    // the body is dropped, as it cannot be redacted
+
+	Encoding    string `json:"encoding,omitempty"`    // Content-Encoding of the body on the wire
+	DecodeError string `json:"decodeError,omitempty"` // if decoding failed, Data is the raw body
+	Raw         []byte `json:"-"`                     // the body on the wire, if kept by Options.RawBody
+	RawFile     string `json:"rawFile,omitempty"`     // filename of the raw body. empty if not saved.
+
+	SniffedType  string `json:"sniffedType,omitempty"`  // Content-Type guessed from the content
+	TypeMismatch bool   `json:"typeMismatch,omitempty"` // the declared Content-Type and the sniffed type disagree
+
+	Charset  string `json:"charset,omitempty"`  // charset of a text body, if not UTF-8
+	UTF8     []byte `json:"-"`                  // the text body transcoded to UTF-8. nil if Data is already in UTF-8.
+	UTF8File string `json:"utf8File,omitempty"` // filename of the UTF-8 copy. empty if not saved.
+
+	Parts []*Part `json:"parts,omitempty"` // parts of a multipart/form-data body
+	GRPC  *GRPC   `json:"grpc,omitempty"`  // messages of a gRPC body
+
+	Pretty     []byte `json:"-"`                    // pretty-printed text. nil if not formatted.
+	PrettyFile string `json:"prettyFile,omitempty"` // filename of the pretty-printed copy. empty if not saved.
+}
+
+// The effective type of the body; the sniffed type if Content-Type is missing or wrong
+func (b *Body) Type() string {
+	if b.SniffedType != "" && (b.ContentType == "" || b.TypeMismatch || strings.HasPrefix(b.ContentType, "application/octet-stream")) {
+		return b.SniffedType
+	}
+	return b.ContentType
+}
+
+// The body as a UTF-8 text, if transcoded. Otherwise the body itself.
+func (b *Body) Text() []byte {
+	if b.UTF8 != nil {
+		return b.UTF8
+	}
+	return b.Data
+}
+
+// Duration of the session. Zero if the session is not finished.
+func (r *SessionRecord) Duration() time.Duration {
+	if r.End.IsZero() {
+		return 0
+	}
+	return r.End.Sub(r.Start)
+}
+
+func newSessionRecord(sessionId int64, conn *Connection) *SessionRecord {
+	r := &SessionRecord{
+		Id:           sessionId,
+		State:        StateRequest,
+		Start:        conn.Start,
+		Method:       conn.Req.Method,
+		Host:         conn.Host,
+		URL:          conn.Req.URL.String(),
+		Path:         conn.Req.URL.Path,
+		RewrittenURL: conn.RewrittenURL,
+		Proto:        conn.Req.Proto,
+		Mark:         conn.Mark,
+		ClientAddr:   conn.ClientAddr,
+		User:         conn.User,
+		Tag:          conn.Tag,
+		Route:        conn.Route,
+		ClientHello:  conn.ClientHello,
+		ClientCerts:  conn.ClientCerts,
+		ServerAddr:   conn.ServerAddr,
+		UpstreamTLS:  conn.UpstreamTLS,
+	}
+	if r.Host == "" {
+		r.Host = conn.Req.URL.Host
+	}
+	r.ReqHeader = conn.Req.Header.Clone()
+	r.ReqContentType = conn.Req.Header.Get("Content-Type")
+	if conn.ReqBody != nil {
+		r.ReqSize = conn.ReqBody.Size
+	}
+	if conn.Resp != nil {
+		r.State = StateResponse
+		r.RespStart = conn.RespStart
+		r.UpstreamProto = conn.Resp.Proto
+		r.Status = conn.Resp.Status
+		r.StatusCode = conn.Resp.StatusCode
+		r.RespHeader = conn.Resp.Header.Clone()
+		r.RespContentType = conn.Resp.Header.Get("Content-Type")
+	}
+	if conn.RespBody != nil {
+		r.RespSize = conn.RespBody.Size
+	}
+	r.ReqTrailer, r.RespTrailer = conn.ReqTrailer.Clone(), conn.RespTrailer.Clone()
+	return r
+}
+
+// Set the capture mark of the following sessions. (e.g. name of a test)
+func (p *Proxy) SetMark(name string) {
+	p.markMutex.Lock()
+	p.mark = name
+	p.markMutex.Unlock()
+}
+
+func (p *Proxy) currentMark() string {
+	p.markMutex.Lock()
+	defer p.markMutex.Unlock()
+	return p.mark
+}
+
+// store a session snapshot to the history, notify it to the subscribers, and send it to the sinks.
+// The record must not be modified after published.
+func (p *Proxy) publish(r *SessionRecord) {
+	if p.redactor != nil {
+		// before the history and the sinks
+		p.redactor.record(r)
+	}
+	p.historyMutex.Lock()
+	if max := p.opt.HistoryMax; max > 0 {
+		p.history[r.Id] = r
+		if len(p.history) > max {
+			// remove the oldest sessions
+			ids := make([]int64, 0, len(p.history))
+			for id := range p.history {
+				ids = append(ids, id)
+			}
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			for _, id := range ids[:len(ids)-max] {
+				delete(p.history, id)
+			}
+		}
+	}
+	for ch := range p.subscribers {
+		select {
+		case ch <- r:
+		default:
+			// the subscriber is too slow; drop the event
+		}
+	}
+	p.historyMutex.Unlock()
+
+	for _, sink := range p.opt.Sinks {
+		err := sink.WriteSession(r)
+		if err != nil {
+			p.reportError(&SinkError{Sink: sink, Err: err})
+		}
+	}
+}
+
+// Get a channel of session updates
+func (p *Proxy) Subscribe() chan *SessionRecord {
+	ch := make(chan *SessionRecord, 256)
+	p.historyMutex.Lock()
+	p.subscribers[ch] = true
+	p.historyMutex.Unlock()
+	return ch
+}
+
+// Stop receiving session updates from a channel given by Subscribe()
+func (p *Proxy) Unsubscribe(ch chan *SessionRecord) {
+	p.historyMutex.Lock()
+	delete(p.subscribers, ch)
+	p.historyMutex.Unlock()
+}
+
+// List of sessions in the history, ordered by session id
+func (p *Proxy) Sessions() []*SessionRecord {
+	p.historyMutex.Lock()
+	defer p.historyMutex.Unlock()
+
+	list := make([]*SessionRecord, 0, len(p.history))
+	for _, r := range p.history {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// Find a session in the history. nil if not found.
+func (p *Proxy) Session(id int64) *SessionRecord {
+	p.historyMutex.Lock()
+	defer p.historyMutex.Unlock()
+	return p.history[id]
+}
+
+// Remove all sessions from the history
+func (p *Proxy) ClearHistory() {
+	p.historyMutex.Lock()
+	p.history = make(map[int64]*SessionRecord)
+	p.historyMutex.Unlock()
+}
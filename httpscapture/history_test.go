@@ -0,0 +1,37 @@
+package httpscapture
+
+import (
+	"testing"
+)
+
+func TestSessionHistory(t *testing.T) {
+
+	p := newTestProxy(t, Options{HistoryMax: 2})
+
+	ch := p.Subscribe()
+	defer p.Unsubscribe(ch)
+
+	for i := int64(1); i <= 3; i++ {
+		p.publish(&SessionRecord{Id: i, State: StateClosed})
+	}
+
+	// subscriber receives all events
+	for i := int64(1); i <= 3; i++ {
+		r := <-ch
+		if r.Id != i {
+			t.Errorf("event order mismatch: expected %d, got %d", i, r.Id)
+		}
+	}
+
+	// the history keeps only the latest sessions
+	list := p.Sessions()
+	if len(list) != 2 || list[0].Id != 2 || list[1].Id != 3 {
+		t.Errorf("invalid history")
+	}
+	if p.Session(1) != nil {
+		t.Errorf("old session not removed")
+	}
+	if p.Session(3) == nil {
+		t.Errorf("session not found")
+	}
+}
@@ -0,0 +1,54 @@
+package httpscapture
+
+//
+// A sink writing sessions in JSON Lines
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// JSONLSink writes finished sessions to W, a JSON object per line.
+// Sessions in progress are not written.
+type JSONLSink struct {
+	W      io.Writer
+	Bodies bool // include the decoded bodies in base64
+
+	mutex sync.Mutex
+}
+
+// a line of JSONL output
+type jsonlRecord struct {
+	*SessionRecord
+	ReqBodyData  []byte `json:"reqBodyData,omitempty"`
+	RespBodyData []byte `json:"respBodyData,omitempty"`
+}
+
+func (s *JSONLSink) WriteSession(rec *SessionRecord) (err error) {
+	if rec.State == StateRequest || rec.State == StateResponse {
+		return
+	}
+	r := jsonlRecord{SessionRecord: rec}
+	if s.Bodies {
+		if rec.ReqBody != nil {
+			r.ReqBodyData = rec.ReqBody.Data
+		}
+		if rec.RespBody != nil {
+			r.RespBodyData = rec.RespBody.Data
+		}
+	}
+	b, err := json.Marshal(&r)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.W.Write(b)
+	return
+}
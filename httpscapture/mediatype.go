@@ -1,4 +1,4 @@
-package main
+package httpscapture
 
 import (
 	"mime"
@@ -14,6 +14,20 @@ var (
 		"text/html":                         ".html",
 		"image/jpeg":                        ".jpg",
 		"application/x-www-form-urlencoded": ".form",
+		"application/json":                  ".json",
+		"multipart/form-data":               ".multipart",
+		"application/grpc":                  ".grpc",
+		"application/grpc+proto":            ".grpc",
+		"application/grpc-web":              ".grpc-web",
+		"application/grpc-web+proto":        ".grpc-web",
+		"application/grpc-web-text":         ".grpc-web-text",
+		"application/grpc-web-text+proto":   ".grpc-web-text",
+		"application/x-protobuf":            ".pb",
+		"application/wasm":                  ".wasm",
+		"application/zip":                   ".zip",
+		"image/webp":                        ".webp",
+		"font/woff":                         ".woff",
+		"font/woff2":                        ".woff2",
 	}
 
 	textMimeCategory = []string{
@@ -25,6 +39,8 @@ var (
 		"application/json",
 		"application/javascript",
 		"application/x-www-form-urlencoded",
+		"application/grpc-web-text",
+		"application/grpc-web-text+proto",
 	}
 )
 
@@ -0,0 +1,302 @@
+package httpscapture
+
+//
+// MITM TLS tunnels, served in HTTP/2 or HTTP/1.1 as negotiated by ALPN
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	//"github.com/elazarl/goproxy"
+	"github.com/mixcode/goproxy" // a clone of elazarl/goproxy with fixes for TLS SNI
+	"golang.org/x/net/http/httpguts"
+)
+
+// protocols offered to the clients
+var mitmNextProtos = []string{"h2", "http/1.1"}
+
+// a CONNECT tunnel
+type tunnel struct {
+	host   string // the CONNECT host
+	client *helloConn
+	from   *clientInfo // the client of the CONNECT request
+}
+
+// context key of the tunnel of a request
+type tunnelKey struct{}
+
+// a listener that accepts hijacked CONNECT tunnels
+type tunnelListener struct {
+	c     chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	conns sync.Map // *tunnel by *tls.Conn, until accepted
+}
+
+func newTunnelListener() *tunnelListener {
+	return &tunnelListener{c: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.c:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tunnelListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *tunnelListener) Addr() net.Addr {
+	return tunnelAddr{}
+}
+
+// push a tunnel to the server. false if the listener is closed.
+func (l *tunnelListener) push(c net.Conn) bool {
+	select {
+	case l.c <- c:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+type tunnelAddr struct{}
+
+func (tunnelAddr) Network() string { return "tunnel" }
+func (tunnelAddr) String() string  { return "tunnel" }
+
+// start the server of MITM tunnels. net/http serves HTTP/2 over TLS connections by itself.
+func (p *Proxy) startMITM() {
+	errorLog := log.New(io.Discard, "", 0)
+	if p.opt.Verbose && p.opt.Output != nil {
+		errorLog = log.New(p.opt.Output, "mitm: ", log.LstdFlags)
+	}
+	p.tunnels = newTunnelListener()
+	p.mitm = &http.Server{
+		Handler:  http.HandlerFunc(p.serveMITM),
+		ErrorLog: errorLog,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			t, _ := p.tunnels.conns.LoadAndDelete(c)
+			return context.WithValue(ctx, tunnelKey{}, t)
+		},
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.mitm.Serve(p.tunnels)
+	}()
+}
+
+// CONNECT hijack handler; wrap the client connection in TLS and pass it to the MITM server
+func (p *Proxy) hijackTLS(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+	_, err := io.WriteString(client, "HTTP/1.0 200 OK\r\n\r\n")
+	if err != nil {
+		client.Close()
+		return
+	}
+	config, err := p.tlsConfig(ctx.Host, ctx)
+	if err != nil {
+		p.printf("TLS config failed for %s: %v\n", ctx.Host, err)
+		client.Close()
+		return
+	}
+	config = config.Clone()
+	config.NextProtos = mitmNextProtos
+	if p.opt.RequestClientCert {
+		config.ClientAuth = tls.RequestClientCert
+	}
+	if p.untrustedTLSConfig != nil {
+		// pass an invalid server cert to the client, by a cert the client does not trust
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if !p.upstreamInvalid(ctx.Host, hello.ServerName) {
+				return nil, nil
+			}
+			c, err := p.untrustedTLSConfig(ctx.Host, ctx)
+			if err != nil {
+				return nil, err
+			}
+			c = c.Clone()
+			c.NextProtos, c.ClientAuth = mitmNextProtos, config.ClientAuth
+			return c, nil
+		}
+	}
+
+	t := &tunnel{host: ctx.Host, client: &helloConn{Conn: client}, from: requestClient(req, ctx)}
+	conn := tls.Server(t.client, config)
+	p.tunnels.conns.Store(conn, t)
+	if !p.tunnels.push(conn) {
+		p.tunnels.conns.Delete(conn)
+		conn.Close()
+	}
+}
+
+// serve a request from a MITM tunnel
+func (p *Proxy) serveMITM(w http.ResponseWriter, r *http.Request) {
+	host := ""
+	if t, ok := r.Context().Value(tunnelKey{}).(*tunnel); ok {
+		host = t.host
+	}
+	if r.Host == "" {
+		r.Host = host
+	}
+	r.URL.Scheme, r.URL.Host = "https", r.Host
+
+	ctx := &goproxy.ProxyCtx{Host: host, Req: r, Proxy: p.proxy}
+	req, resp := p.reqHandler(r, ctx)
+	if resp == nil {
+		if !isUpgrade(req.Header) {
+			removeHopHeaders(req.Header)
+		}
+		req.Trailer = r.Trailer // filled when the body is read
+		var err error
+		resp, err = ctx.RoundTrip(req)
+		if err != nil {
+			ctx.Error = err
+			resp = nil
+		}
+	}
+	ctx.Resp = resp
+	resp = p.respHandler(resp, ctx)
+	if resp == nil {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		p.serveUpgrade(w, resp)
+		return
+	}
+
+	h := w.Header()
+	for k, v := range resp.Header {
+		h[k] = v
+	}
+	removeHopHeaders(h)
+	announced := map[string]bool{}
+	for k := range resp.Trailer {
+		h.Add("Trailer", k)
+		announced[k] = true
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	err := copyFlush(w, resp.Body)
+	if err != nil {
+		// let the client know the body is incomplete
+		panic(http.ErrAbortHandler)
+	}
+	for k, v := range resp.Trailer {
+		if !announced[k] {
+			k = http.TrailerPrefix + k
+		}
+		h[k] = v
+	}
+}
+
+// relay a protocol switched connection, e.g. WebSocket
+func (p *Proxy) serveUpgrade(w http.ResponseWriter, resp *http.Response) {
+	var upstream io.ReadWriteCloser
+	if b, ok := resp.Body.(*CaptureReadCloser); ok {
+		// the stream is not captured
+		upstream, _ = b.C.(io.ReadWriteCloser)
+	}
+	hj, ok := w.(http.Hijacker)
+	if upstream == nil || !ok {
+		http.Error(w, "protocol switching not supported", http.StatusBadGateway)
+		return
+	}
+	client, brw, err := hj.Hijack()
+	if err != nil {
+		p.printf("hijack failed: %v\n", err)
+		return
+	}
+	defer client.Close()
+
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if brw.Flush() != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	relay := func(dst io.Writer, src io.Reader) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go relay(upstream, brw.Reader)
+	go relay(client, upstream)
+	<-done
+}
+
+// copy a response body, flushing each chunk for streaming responses
+func copyFlush(w http.ResponseWriter, r io.Reader) error {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			_, e := w.Write(buf[:n])
+			if e != nil {
+				return e
+			}
+			rc.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// hop-by-hop headers, not to be forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+	te := h.Get("Te")
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+	if httpguts.HeaderValuesContainsToken([]string{te}, "trailers") {
+		// required by gRPC
+		h.Set("Te", "trailers")
+	}
+}
+
+func isUpgrade(h http.Header) bool {
+	return httpguts.HeaderValuesContainsToken(h["Connection"], "upgrade") && h.Get("Upgrade") != ""
+}
@@ -0,0 +1,141 @@
+package httpscapture
+
+//
+// Splitting multipart/form-data bodies into parts
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// A part of a multipart/form-data body
+type Part struct {
+	Index              int    `json:"index"` // 1-based index of the part
+	Name               string `json:"name,omitempty"`
+	FileName           string `json:"fileName,omitempty"`
+	ContentType        string `json:"contentType,omitempty"`
+	ContentDisposition string `json:"contentDisposition,omitempty"`
+	Size               int    `json:"size"`
+	IsField            bool   `json:"isField,omitempty"` // a text form field, written inline to the log
+	Data               []byte `json:"-"`
+	File               string `json:"file,omitempty"` // filename to be saved in the capture directory. empty if not saved.
+}
+
+// split a multipart/form-data body. nil if not a multipart body.
+func parseMultipart(data []byte, contentType string) (parts []*Part, err error) {
+	mtype, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mtype != "multipart/form-data" {
+		return nil, err
+	}
+	if params["boundary"] == "" {
+		return nil, fmt.Errorf("multipart boundary not found")
+	}
+	r := multipart.NewReader(bytes.NewReader(data), params["boundary"])
+	for i := 1; ; i++ {
+		p, e := r.NextRawPart()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return nil, e
+		}
+		content, e := io.ReadAll(p)
+		if e != nil {
+			return nil, e
+		}
+		part := &Part{
+			Index:              i,
+			Name:               p.FormName(),
+			FileName:           p.FileName(),
+			ContentType:        p.Header.Get("Content-Type"),
+			ContentDisposition: p.Header.Get("Content-Disposition"),
+			Size:               len(content),
+			Data:               content,
+		}
+		part.IsField = part.FileName == "" && (part.ContentType == "" || strings.HasPrefix(part.ContentType, "text/")) && utf8.Valid(content)
+		parts = append(parts, part)
+	}
+	return
+}
+
+// build a multipart/form-data body of the parts, with the boundary of contentType.
+// Only Content-Disposition and Content-Type headers of the parts are kept.
+func writeMultipart(parts []*Part, contentType string) ([]byte, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	err = w.SetBoundary(params["boundary"])
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		h := make(textproto.MIMEHeader)
+		if part.ContentDisposition != "" {
+			h.Set("Content-Disposition", part.ContentDisposition)
+		}
+		if part.ContentType != "" {
+			h.Set("Content-Type", part.ContentType)
+		}
+		pw, err := w.CreatePart(h)
+		if err != nil {
+			return nil, err
+		}
+		pw.Write(part.Data)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// filename of a file part; e.g. 000123_a_part2_photo.jpg
+func partFilename(sessionId int64, part *Part) string {
+	name := part.FileName
+	if name == "" {
+		name = part.Name
+		ext := ""
+		if part.ContentType != "" {
+			_, _, ext, _, _ = mediaType(part.ContentType)
+		}
+		if ext == "" {
+			ext = ".bin"
+		}
+		name += ext
+	}
+
+	// the client's filename may contain a path, or unsafe characters
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "." || name == "/" {
+		name = "unknown"
+	}
+
+	// trim if the filename is too long
+	ext := path.Ext(name)
+	if len(ext) > filenameMaxLen {
+		ext = ""
+	}
+	if body := name[:len(name)-len(ext)]; len(body) > filenameMaxLen {
+		name = body[:filenameMaxLen] + ext
+	}
+	return fmt.Sprintf("%06d_a_part%d_%s", sessionId, part.Index, name)
+}
@@ -0,0 +1,37 @@
+package httpscapture
+
+import (
+	"testing"
+)
+
+func TestParseMultipart(t *testing.T) {
+	body := "--xx\r\nContent-Disposition: form-data; name=\"title\"\r\n\r\nhello\r\n" +
+		"--xx\r\nContent-Disposition: form-data; name=\"file\"; filename=\"C:\\\\photos\\\\a b.png\"\r\nContent-Type: image/png\r\n\r\n\x89PNG\r\n" +
+		"--xx\r\nContent-Disposition: form-data; name=\"blob\"\r\nContent-Type: application/octet-stream\r\n\r\n\x00\x01\r\n--xx--\r\n"
+
+	parts, err := parseMultipart([]byte(body), "multipart/form-data; boundary=xx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d", len(parts))
+	}
+	if !parts[0].IsField || parts[0].Name != "title" || string(parts[0].Data) != "hello" {
+		t.Errorf("invalid field part")
+	}
+	if parts[1].IsField || parts[1].ContentType != "image/png" || parts[1].Size != 4 {
+		t.Errorf("invalid file part")
+	}
+	if name := partFilename(123, parts[1]); name != "000123_a_part2_a b.png" {
+		t.Errorf("invalid part filename: %s", name)
+	}
+	if name := partFilename(123, parts[2]); name != "000123_a_part3_blob.bin" {
+		t.Errorf("invalid part filename: %s", name)
+	}
+
+	// not a multipart
+	parts, err = parseMultipart([]byte("a=1"), "application/x-www-form-urlencoded")
+	if parts != nil || err != nil {
+		t.Errorf("non-multipart body parsed")
+	}
+}
@@ -0,0 +1,183 @@
+package httpscapture
+
+//
+// Pretty-printing of JSON, XML and form bodies
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// format a text body for human. nil if the type is not supported or the body is malformed.
+func prettyBody(data []byte, contentType string) []byte {
+	mtype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	switch {
+	case mtype == "application/json" || strings.HasSuffix(mtype, "+json"):
+		var buf bytes.Buffer
+		if json.Indent(&buf, data, "", "  ") != nil {
+			return nil
+		}
+		buf.WriteByte('\n')
+		return buf.Bytes()
+
+	case mtype == "application/xml" || mtype == "text/xml" || strings.HasSuffix(mtype, "+xml"):
+		return prettyXML(data)
+
+	case mtype == "application/x-www-form-urlencoded":
+		return formLines(data)
+
+	case mtype == "multipart/form-data":
+		return prettyMultipart(data, contentType)
+	}
+	return nil
+}
+
+// x-www-form-urlencoded body as "key=[values]" lines, sorted by keys
+func formLines(data []byte) []byte {
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s=%s\n", k, values[k])
+	}
+	return buf.Bytes()
+}
+
+// re-indent a XML document
+func prettyXML(data []byte) []byte {
+	// read all tokens first, to put text-only elements in a line
+	var tokens []xml.Token
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil
+		}
+		if c, ok := t.(xml.CharData); ok && len(bytes.TrimSpace(c)) == 0 {
+			continue // indentation of the original
+		}
+		tokens = append(tokens, xml.CopyToken(t))
+	}
+
+	qname := func(n xml.Name) string {
+		if n.Space != "" {
+			return n.Space + ":" + n.Local
+		}
+		return n.Local
+	}
+	var buf bytes.Buffer
+	depth := 0
+	newline := func() {
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(strings.Repeat("  ", depth))
+	}
+	for i := 0; i < len(tokens); i++ {
+		switch t := tokens[i].(type) {
+		case xml.StartElement:
+			newline()
+			buf.WriteString("<" + qname(t.Name))
+			for _, a := range t.Attr {
+				buf.WriteString(" " + qname(a.Name) + `="`)
+				xml.EscapeText(&buf, []byte(a.Value))
+				buf.WriteString(`"`)
+			}
+			if i+1 < len(tokens) {
+				if _, ok := tokens[i+1].(xml.EndElement); ok {
+					// an empty element
+					buf.WriteString("/>")
+					i++
+					continue
+				}
+			}
+			buf.WriteString(">")
+			if i+2 < len(tokens) {
+				c, ok1 := tokens[i+1].(xml.CharData)
+				e, ok2 := tokens[i+2].(xml.EndElement)
+				if ok1 && ok2 {
+					// a text-only element
+					xml.EscapeText(&buf, c)
+					buf.WriteString("</" + qname(e.Name) + ">")
+					i += 2
+					continue
+				}
+			}
+			depth++
+		case xml.EndElement:
+			if depth > 0 {
+				depth--
+			}
+			newline()
+			buf.WriteString("</" + qname(t.Name) + ">")
+		case xml.CharData:
+			newline()
+			xml.EscapeText(&buf, bytes.TrimSpace(t))
+		case xml.Comment:
+			newline()
+			buf.WriteString("<!--" + string(t) + "-->")
+		case xml.ProcInst:
+			newline()
+			buf.WriteString("<?" + t.Target + " " + string(t.Inst) + "?>")
+		case xml.Directive:
+			newline()
+			buf.WriteString("<!" + string(t) + ">")
+		}
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// list fields and files of a multipart/form-data body
+func prettyMultipart(data []byte, contentType string) []byte {
+	parts, err := parseMultipart(data, contentType)
+	if err != nil || parts == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, part := range parts {
+		fmt.Fprintf(&buf, "--- part %d: name=%q", part.Index, part.Name)
+		if part.FileName != "" {
+			fmt.Fprintf(&buf, " filename=%q", part.FileName)
+		}
+		if part.IsField {
+			buf.WriteString("\n")
+			buf.Write(part.Data)
+			buf.WriteString("\n")
+		} else {
+			ct := part.ContentType
+			if ct == "" {
+				ct = "application/octet-stream"
+			}
+			fmt.Fprintf(&buf, " (%s, %d bytes)\n", ct, part.Size)
+		}
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,34 @@
+package httpscapture
+
+import (
+	"testing"
+)
+
+func TestPrettyBody(t *testing.T) {
+	cases := []struct {
+		data, ctype, pretty string
+	}{
+		{`{"b":[1,2],"a":{}}`, "application/json", "{\n  \"b\": [\n    1,\n    2\n  ],\n  \"a\": {}\n}\n"},
+		{`{"a":1}`, "application/vnd.api+json; charset=utf-8", "{\n  \"a\": 1\n}\n"},
+		{`<?xml version="1.0"?><a x="1"><b>text</b><c/><d><e>1</e></d></a>`, "text/xml",
+			"<?xml version=\"1.0\"?>\n<a x=\"1\">\n  <b>text</b>\n  <c/>\n  <d>\n    <e>1</e>\n  </d>\n</a>\n"},
+		{"z=1&a=2&m=3&a=4", "application/x-www-form-urlencoded", "a=[2 4]\nm=[3]\nz=[1]\n"},
+		{"--xx\r\nContent-Disposition: form-data; name=\"title\"\r\n\r\nhello\r\n" +
+			"--xx\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.png\"\r\nContent-Type: image/png\r\n\r\n\x89PNG\r\n--xx--\r\n",
+			"multipart/form-data; boundary=xx",
+			"--- part 1: name=\"title\"\nhello\n--- part 2: name=\"file\" filename=\"a.png\" (image/png, 4 bytes)\n"},
+	}
+	for _, c := range cases {
+		if p := string(prettyBody([]byte(c.data), c.ctype)); p != c.pretty {
+			t.Errorf("%s: unexpected output:\n%s", c.ctype, p)
+		}
+	}
+
+	// malformed and unsupported bodies
+	if prettyBody([]byte(`{"a":`), "application/json") != nil {
+		t.Errorf("malformed JSON formatted")
+	}
+	if prettyBody([]byte("text"), "text/plain") != nil {
+		t.Errorf("plain text formatted")
+	}
+}
@@ -0,0 +1,448 @@
+// Package httpscapture is a MITM proxy to peek and save HTTP/HTTPS connections.
+//
+// A Proxy is built from Options with New(), and started with Start().
+// Captured sessions are sent to Sinks; a text log, body files, JSONL and HAR are provided.
+//
+// github.com/mixcode, 2021-04
+package httpscapture
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	//"github.com/elazarl/goproxy"
+	"github.com/mixcode/goproxy" // a clone of elazarl/goproxy with fixes for TLS SNI
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const (
+	DefaultListenAddr = ":38080"
+
+	filenameMaxLen = 32
+)
+
+var (
+	// host:port matcher
+	mMatchHost = regexp.MustCompile(`^(.*):(\d+)$`)
+)
+
+// Options of a Proxy
+type Options struct {
+	Addr string // proxy listen address. DefaultListenAddr if empty.
+
+	// Users of the proxy, authenticated by Proxy-Authorization Basic auth. No authentication if empty.
+	Users Users
+	// IP ranges of the clients allowed to use the proxy. All clients are allowed if empty.
+	AllowClients []*net.IPNet
+	// IP ranges of the clients denied, even if in AllowClients
+	DenyClients []*net.IPNet
+
+	// Root CA cert and its private key to sign MITM certs.
+	// CACert may be an intermediate CA, with the certs up to the root in CAChain.
+	CACert  *x509.Certificate
+	CAKey   crypto.PrivateKey
+	CAChain []*x509.Certificate // sent to the clients along with CACert, in the order of issuers
+
+	// Captured sessions are sent to all of the sinks, in order.
+	// A failing sink is reported by Proxy.Errors() and does not stop the others.
+	Sinks []Sink
+
+	// Directory of the saved body files. Bodies are not saved if empty.
+	// The bodies of a routed session are in the subdirectory of the route.
+	CaptureDir string
+
+	// A request header tagging the session with its value, e.g. "X-Capture-Tag". The header is not forwarded.
+	// Sessions are not tagged if empty.
+	TagHeader string
+	// Rules routing the sessions to SessionRecord.Route, in order. The first matching rule is used.
+	Routes []*Route
+	// Route the sessions not matching Routes by the client; RouteByIP, RouteByUser, RouteByTag, or not at all if empty
+	RouteBy string
+	// Max number of the routes made by RouteBy. DefaultMaxRoutes if 0.
+	// The sessions of further clients are not routed.
+	MaxRoutes int
+
+	LogPostInline    bool // log request bodies inline instead of saving to files, if the body is a text
+	LogPostInlineAll bool // log request bodies inline instead of saving to files
+
+	RawBody  bool // keep encoded bodies in its on-wire form along with the decoded form
+	SaveUTF8 bool // save a UTF-8 copy of text bodies in other charsets
+	Pretty   bool // pretty-print JSON, XML and form bodies in the log and in extra files
+
+	// Descriptors to decode gRPC messages to JSON. Messages are dumped in raw wire format if nil.
+	ProtoFiles *protoregistry.Files
+
+	NonTLSPorts []int // CONNECT to these ports are treated as non-TLS
+
+	// Verification of the server certificates; VerifyInsecure (default if empty), VerifyWarn or VerifyStrict
+	UpstreamVerify string
+	// Trusted roots to verify the server certificates. The system roots are used if nil.
+	UpstreamRoots *x509.CertPool
+
+	// Serve a page to download the root CA cert to the proxied clients at http://https-capture.cert/
+	CertPage bool
+
+	// Key type of the MITM certs; LeafKeyECDSA, LeafKeyRSA, or the type of CAKey if empty
+	LeafKey string
+	// Validity of the MITM certs. 30 days if 0.
+	LeafValidity time.Duration
+	// Copy the subject, the SANs and the validity of the server cert to the MITM certs
+	MirrorUpstream bool
+
+	// Handling of the hosts outside the name constraints of the CA; ConstraintTunnel (default if empty) or ConstraintRefuse
+	OutsideConstraints string
+
+	// Client certs presented to the servers that request one. The first one matching the host is used.
+	ClientCerts []*ClientCert
+	// Ask the clients for a cert, to record what they offer. The cert is not verified.
+	RequestClientCert bool
+
+	// Save files only if Content-Type is in this list
+	SaveContentTypes []string
+	// Save files only if filename is matched with one of these regexes
+	SaveIfMatch []*regexp.Regexp
+
+	// Redaction of secrets in the headers, the URLs and the bodies, before the history and the sinks. No redaction if nil.
+	Redact *Redaction
+
+	HistoryMax int // max number of sessions kept in the history. 0 to disable the history.
+
+	Output  io.Writer // connection messages are printed to Output, if not nil
+	Verbose bool      // print internal proxy log
+}
+
+// A MITM proxy that captures HTTP(s) sessions
+type Proxy struct {
+	opt Options
+
+	proxy    *goproxy.ProxyHttpServer
+	handler  http.Handler // the proxy engine behind the access control
+	server   *http.Server
+	listener net.Listener
+	wg       sync.WaitGroup
+	done     chan struct{}
+	closed   bool
+	errc     chan error
+
+	nonTLSPort map[int]bool
+	redactor   *redactor // nil if not redacted
+
+	// the server of MITM TLS tunnels
+	tlsConfig func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error)
+	mitm      *http.Server
+	tunnels   *tunnelListener
+
+	// certs from an untrusted CA, given to the clients if the server cert is not valid. nil if not VerifyWarn.
+	untrustedTLSConfig func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error)
+	probeMutex         sync.Mutex
+	probes             map[string]*probeResult
+
+	// sessions in progress
+	sessionMutex  sync.Mutex
+	session       map[int64]*Connection
+	lastSessionId int64
+
+	// filters and runtime rules
+	ruleMutex            sync.RWMutex
+	saveIfMatch          []*regexp.Regexp // if set, save files that match with this regexes
+	doNotSaveIfMatch     []*regexp.Regexp // if set, do not save the files
+	saveContentType      map[string]bool  // if set, save files that Content-Type is in this list
+	doNotSaveContentType map[string]bool  // if set, do not save that Content-Type is in this list
+	blockIfMatch         []*Rule
+	rewriteRules         []*Rule
+	rules                map[int64]*Rule
+	lastRuleId           int64
+	saveBodies           int32 // if 0, bodies are not saved to files
+
+	// session history
+	historyMutex sync.Mutex
+	history      map[int64]*SessionRecord
+	subscribers  map[chan *SessionRecord]bool
+
+	markMutex sync.Mutex
+	mark      string
+
+	// routes made by RouteBy
+	routeMutex sync.Mutex
+	autoRoutes map[string]bool
+	routesFull bool // warned of too many routes
+}
+
+// Create a new proxy
+func New(opt Options) (p *Proxy, err error) {
+	if opt.CACert == nil || opt.CAKey == nil {
+		return nil, fmt.Errorf("root CA cert and key must be given")
+	}
+	if opt.Addr == "" {
+		opt.Addr = DefaultListenAddr
+	}
+	if opt.MaxRoutes == 0 {
+		opt.MaxRoutes = DefaultMaxRoutes
+	}
+	switch opt.UpstreamVerify {
+	case "":
+		opt.UpstreamVerify = VerifyInsecure
+	case VerifyInsecure, VerifyWarn, VerifyStrict:
+	default:
+		return nil, fmt.Errorf("unknown verification policy: %s", opt.UpstreamVerify)
+	}
+	switch opt.RouteBy {
+	case "", RouteByIP, RouteByUser, RouteByTag:
+	default:
+		return nil, fmt.Errorf("unknown routing: %s", opt.RouteBy)
+	}
+	if opt.TagHeader == "" {
+		for _, r := range opt.Routes {
+			if len(r.Tags) > 0 {
+				return nil, fmt.Errorf("route %s: routing by tag requires a tag header", r.Name)
+			}
+		}
+		if opt.RouteBy == RouteByTag {
+			return nil, fmt.Errorf("routing by tag requires a tag header")
+		}
+	}
+	switch opt.LeafKey {
+	case "", LeafKeyECDSA, LeafKeyRSA:
+	default:
+		return nil, fmt.Errorf("unknown leaf key type: %s", opt.LeafKey)
+	}
+	switch opt.OutsideConstraints {
+	case "":
+		opt.OutsideConstraints = ConstraintTunnel
+	case ConstraintTunnel, ConstraintRefuse:
+	default:
+		return nil, fmt.Errorf("unknown handling of the hosts outside the name constraints: %s", opt.OutsideConstraints)
+	}
+
+	p = &Proxy{
+		opt:         opt,
+		done:        make(chan struct{}),
+		errc:        make(chan error, 16),
+		nonTLSPort:  make(map[int]bool),
+		session:     make(map[int64]*Connection),
+		rules:       make(map[int64]*Rule),
+		saveBodies:  1,
+		history:     make(map[int64]*SessionRecord),
+		subscribers: make(map[chan *SessionRecord]bool),
+		probes:      make(map[string]*probeResult),
+	}
+	for _, port := range opt.NonTLSPorts {
+		p.nonTLSPort[port] = true
+	}
+	if len(opt.SaveContentTypes) > 0 {
+		p.saveContentType = make(map[string]bool)
+		for _, s := range opt.SaveContentTypes {
+			p.saveContentType[s] = true
+		}
+	}
+	p.saveIfMatch = append(p.saveIfMatch, opt.SaveIfMatch...)
+	if opt.Redact != nil {
+		p.redactor, err = newRedactor(opt.Redact)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the signer of MITM certs
+	s, err := newSigner(opt.CACert, opt.CAKey, opt.CAChain)
+	if err != nil {
+		return nil, err
+	}
+	p.leafOptions(s)
+
+	// prepare the proxy engine
+	proxy := goproxy.NewProxyHttpServer()
+
+	// TLS tunnels are served by our own server, to speak HTTP/2 to the clients
+	p.tlsConfig = s.tlsConfig
+	tlsConnectAction := &goproxy.ConnectAction{ // new connection handler
+		Action: goproxy.ConnectHijack,
+		Hijack: p.hijackTLS,
+	}
+	rawConnectAction := &goproxy.ConnectAction{
+		Action:    goproxy.ConnectHTTPMitm,
+		TLSConfig: s.tlsConfig,
+	}
+	var connectHandler goproxy.FuncHttpsHandler = func(host string, proxyCtx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		// passed to the requests in the tunnel
+		proxyCtx.UserData = requestClient(proxyCtx.Req, proxyCtx)
+		m := mMatchHost.FindStringSubmatch(host)
+		if m != nil {
+			// see the port number and test for non-TLS ports
+			port, e := strconv.Atoi(m[2])
+			if e == nil && p.nonTLSPort[port] {
+				p.printf("RAW CONNECT: host[%s], %v\n", host, proxyCtx.Req)
+				return rawConnectAction, host
+			}
+		}
+		if s.constrained() && !s.permits(hostName(host)) {
+			// the clients would reject the certs of the host
+			if p.opt.OutsideConstraints == ConstraintRefuse {
+				p.printf("REFUSED CONNECT: host[%s] is outside the name constraints of the CA\n", host)
+				return goproxy.RejectConnect, host
+			}
+			p.printf("TUNNEL CONNECT: host[%s] is outside the name constraints of the CA\n", host)
+			return goproxy.OkConnect, host
+		}
+		p.printf("TLS CONNECT: host[%s], %v\n", host, proxyCtx.Req)
+
+		return tlsConnectAction, host
+	}
+	proxy.OnRequest().HandleConnect(connectHandler)
+
+	proxy.OnRequest().DoFunc(p.reqHandler)   // http request handler
+	proxy.OnResponse().DoFunc(p.respHandler) // http response handler
+
+	// use HTTP/2 to the servers if available
+	proxy.Tr.ForceAttemptHTTP2 = true
+
+	// the server certs are verified by ourselves
+	proxy.Tr.TLSClientConfig = proxy.Tr.TLSClientConfig.Clone()
+	proxy.Tr.TLSClientConfig.InsecureSkipVerify = true
+	if len(opt.ClientCerts) > 0 {
+		proxy.Tr.TLSClientConfig.GetClientCertificate = p.clientCertificate
+	}
+	switch opt.UpstreamVerify {
+	case VerifyStrict:
+		proxy.Tr.TLSClientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return p.verifyUpstream(&state, state.ServerName)
+		}
+	case VerifyWarn:
+		ca, key, e := newUntrustedCA()
+		if e != nil {
+			return nil, e
+		}
+		untrusted, e := newSigner(ca, key, nil)
+		if e != nil {
+			return nil, e
+		}
+		p.leafOptions(untrusted)
+		p.untrustedTLSConfig = untrusted.tlsConfig
+	}
+
+	if opt.Verbose {
+		proxy.Verbose = goproxy.LOGLEVEL_VERBOSE
+	} else {
+		proxy.Verbose = goproxy.LOGLEVEL_NONE
+	}
+	p.proxy = proxy
+	p.handler = http.HandlerFunc(p.serveProxy)
+	p.startMITM()
+
+	return p, nil
+}
+
+// set the options of the MITM certs to a signer
+func (p *Proxy) leafOptions(s *signer) {
+	s.keyType, s.validity = p.opt.LeafKey, p.opt.LeafValidity
+	if p.opt.MirrorUpstream {
+		s.upstream = p.upstreamCert
+	}
+}
+
+// Start listening and serving the proxy in background.
+// The proxy is closed when ctx is done.
+func (p *Proxy) Start(ctx context.Context) (err error) {
+	if p.server != nil {
+		return fmt.Errorf("proxy already started")
+	}
+	ln, err := net.Listen("tcp", p.opt.Addr)
+	if err != nil {
+		return
+	}
+	p.listener = ln
+	p.server = &http.Server{Handler: p.handler}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		e := p.server.Serve(ln)
+		if e != nil && e != http.ErrServerClosed {
+			p.reportError(e)
+		}
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Close()
+		case <-p.done:
+		}
+	}()
+	return
+}
+
+// Stop the proxy
+func (p *Proxy) Close() (err error) {
+	p.sessionMutex.Lock()
+	if p.closed {
+		p.sessionMutex.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.done)
+	p.sessionMutex.Unlock()
+
+	if p.server != nil {
+		err = p.server.Shutdown(context.TODO())
+	}
+	e := p.mitm.Shutdown(context.TODO())
+	if err == nil {
+		err = e
+	}
+	p.wg.Wait()
+
+	// close the sinks
+	for _, sink := range p.opt.Sinks {
+		if c, ok := sink.(io.Closer); ok {
+			e := c.Close()
+			if err == nil && e != nil {
+				err = &SinkError{Sink: sink, Err: e}
+			}
+		}
+	}
+	return
+}
+
+// The actual listening address of the started proxy
+func (p *Proxy) Addr() net.Addr {
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Addr()
+}
+
+// The proxy as a http.Handler, to be served by another server.
+// The access control of Options is applied.
+func (p *Proxy) Handler() http.Handler {
+	return p.handler
+}
+
+// Errors from the proxy and the sinks. Sink errors are *SinkError.
+func (p *Proxy) Errors() <-chan error {
+	return p.errc
+}
+
+func (p *Proxy) reportError(err error) {
+	select {
+	case p.errc <- err:
+	default:
+		// an error is already pending
+	}
+}
+
+func (p *Proxy) printf(format string, arg ...interface{}) {
+	if p.opt.Output != nil {
+		fmt.Fprintf(p.opt.Output, format, arg...)
+	}
+}
@@ -0,0 +1,224 @@
+package httpscapture
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a sink that collects closed sessions
+type testSink struct {
+	closed chan *SessionRecord
+}
+
+func (s *testSink) WriteSession(rec *SessionRecord) error {
+	if rec.State == StateClosed || rec.State == StateFailed {
+		s.closed <- rec
+	}
+	return nil
+}
+
+// create a proxy with a throwaway CA
+func newTestProxy(t *testing.T, opt Options) *Proxy {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "https_capture test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt.CACert, opt.CAKey = cert, key
+	if opt.Addr == "" {
+		opt.Addr = "127.0.0.1:0"
+	}
+	p, err := New(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// run a GET request through the proxy
+func proxyGet(t *testing.T, p *Proxy, target string) string {
+	proxyURL, _ := url.Parse("http://" + p.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// a HTTP client through the proxy, trusting the proxy CA
+func proxyClient(p *Proxy, insecure bool) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(p.opt.CACert)
+	proxyURL, _ := url.Parse("http://" + p.Addr().String())
+	return &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		TLSClientConfig:   &tls.Config{RootCAs: roots, InsecureSkipVerify: insecure},
+		ForceAttemptHTTP2: true,
+	}}
+}
+
+func TestProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	// two proxies in a process
+	var sinks [2]*testSink
+	var proxies [2]*Proxy
+	for i := range proxies {
+		sinks[i] = &testSink{closed: make(chan *SessionRecord, 4)}
+		proxies[i] = newTestProxy(t, Options{Sinks: []Sink{sinks[i]}, HistoryMax: 10})
+		err := proxies[i].Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer proxies[i].Close()
+	}
+
+	for i, p := range proxies {
+		path := []string{"/a", "/b"}[i]
+		if body := proxyGet(t, p, backend.URL+path); body != "hello "+path {
+			t.Errorf("invalid response body: %s", body)
+		}
+		select {
+		case rec := <-sinks[i].closed:
+			if rec.Path != path || rec.StatusCode != 200 {
+				t.Errorf("invalid session record: %s %d", rec.Path, rec.StatusCode)
+			}
+			if rec.RespBody == nil || string(rec.RespBody.Data) != "hello "+path {
+				t.Errorf("response body not captured")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("session not closed")
+		}
+		if len(p.Sessions()) != 1 {
+			t.Errorf("sessions are mixed between proxies")
+		}
+	}
+}
+
+func TestProxyHTTP2(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "hello "+r.Proto)
+		w.Header().Set("X-Checksum", "1234")
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	sink := &testSink{closed: make(chan *SessionRecord, 4)}
+	p := newTestProxy(t, Options{Sinks: []Sink{sink}})
+	err := p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	resp, err := proxyClient(p, false).Get(backend.URL + "/h2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Proto != "HTTP/2.0" || string(b) != "hello HTTP/2.0" {
+		t.Errorf("HTTP/2 not used: client %s, server %s", resp.Proto, b)
+	}
+	if resp.Trailer.Get("X-Checksum") != "1234" {
+		t.Errorf("trailer not relayed: %v", resp.Trailer)
+	}
+
+	select {
+	case rec := <-sink.closed:
+		if rec.Proto != "HTTP/2.0" || rec.UpstreamProto != "HTTP/2.0" {
+			t.Errorf("invalid protocols: %s %s", rec.Proto, rec.UpstreamProto)
+		}
+		if rec.RespTrailer.Get("X-Checksum") != "1234" {
+			t.Errorf("trailer not captured: %v", rec.RespTrailer)
+		}
+		if rec.ClientHello == nil || !strings.HasPrefix(rec.ClientHello.JA4, "t13i") {
+			t.Errorf("ClientHello not captured: %+v", rec.ClientHello)
+		}
+		if rec.ServerAddr != backend.Listener.Addr().String() || rec.UpstreamTLS == nil || len(rec.UpstreamTLS.Certificates) == 0 || rec.UpstreamTLS.ALPN != "h2" {
+			t.Errorf("upstream TLS not captured: %s %+v", rec.ServerAddr, rec.UpstreamTLS)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session not closed")
+	}
+}
+
+func TestTimings(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(w, "slow")
+	}))
+	defer backend.Close()
+
+	sink := &testSink{closed: make(chan *SessionRecord, 4)}
+	p := newTestProxy(t, Options{Sinks: []Sink{sink}})
+	err := p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		proxyGet(t, p, backend.URL)
+		select {
+		case rec := <-sink.closed:
+			tm := rec.Timings
+			if tm == nil {
+				t.Fatalf("timings not recorded")
+			}
+			if tm.Wait < 20*time.Millisecond {
+				t.Errorf("invalid wait time: %v", tm.Wait)
+			}
+			if i == 0 && (tm.Reused || tm.Connect == 0) {
+				t.Errorf("connect time not recorded: %v", tm)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("session not closed")
+		}
+	}
+}
@@ -0,0 +1,536 @@
+package httpscapture
+
+//
+// Redaction of secrets in the session records, before they are given to the sinks
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Redaction modes
+const (
+	RedactMask = "mask" // a secret is replaced with "REDACTED"
+	RedactHash = "hash" // a secret is replaced with "REDACTED-" and its keyed hash, so equal secrets are still equal
+)
+
+var (
+	// Headers redacted by default
+	DefaultRedactHeaders = []string{
+		"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+		"X-Api-Key", "X-Auth-Token", "X-Access-Token", "X-Csrf-Token", "X-Xsrf-Token", "X-Amz-Security-Token",
+	}
+	// Query, form and multipart params, and JSON keys, redacted by default. Compared case-insensitively.
+	DefaultRedactParams = []string{
+		"password", "passwd", "pwd", "secret", "client_secret",
+		"token", "access_token", "refresh_token", "id_token", "api_key", "apikey",
+		"auth", "session", "sessionid", "signature", "sig",
+		"x-amz-signature", "x-amz-credential", "x-amz-security-token",
+	}
+
+	// Patterns for Redaction.Patterns
+	RedactJWT        = regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	RedactCardNumber = regexp.MustCompile(`\b[3-6]\d{3}(?:[ -]?\d{4}){2}[ -]?\d{1,7}\b`)
+)
+
+// headers with URLs, of which the params are redacted
+var urlHeaders = []string{"Location", "Content-Location", "Referer"}
+
+// Rules to redact secrets from the records.
+// The headers and the params of DefaultRedactHeaders and DefaultRedactParams are always redacted.
+type Redaction struct {
+	Mode string // RedactMask (default if empty) or RedactHash
+	Key  []byte // key of RedactHash. A random key is used if empty, and the hashes are consistent only in the process.
+
+	Headers []string // names of additional headers
+	Params  []string // names of additional query, form and multipart params, and JSON keys
+
+	// Patterns in the bodies, e.g. RedactJWT. The first group is redacted if the pattern has one, or the whole match.
+	Patterns []*regexp.Regexp
+
+	// Values in JSON bodies, e.g. "$.user.password", "$.items[*].card", "$..token"
+	JSONPaths []string
+}
+
+// the compiled rules of a Redaction
+type redactor struct {
+	mode     string
+	key      []byte
+	headers  map[string]bool // in canonical form
+	params   map[string]bool // in lower case
+	patterns []*regexp.Regexp
+	paths    []jsonPath
+}
+
+func newRedactor(rd *Redaction) (r *redactor, err error) {
+	r = &redactor{
+		mode:     rd.Mode,
+		key:      rd.Key,
+		headers:  make(map[string]bool),
+		params:   make(map[string]bool),
+		patterns: rd.Patterns,
+	}
+	switch r.mode {
+	case "":
+		r.mode = RedactMask
+	case RedactMask, RedactHash:
+	default:
+		return nil, fmt.Errorf("unknown redaction mode: %s", rd.Mode)
+	}
+	if r.mode == RedactHash && len(r.key) == 0 {
+		r.key = make([]byte, 32)
+		if _, err = rand.Read(r.key); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range append(append([]string{}, DefaultRedactHeaders...), rd.Headers...) {
+		r.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, p := range append(append([]string{}, DefaultRedactParams...), rd.Params...) {
+		r.params[strings.ToLower(p)] = true
+	}
+	for _, s := range rd.JSONPaths {
+		jp, e := parseJSONPath(s)
+		if e != nil {
+			return nil, e
+		}
+		r.paths = append(r.paths, jp)
+	}
+	return
+}
+
+// the replacement of a secret
+func (r *redactor) replace(secret string) string {
+	if r.mode != RedactHash {
+		return "REDACTED"
+	}
+	m := hmac.New(sha256.New, r.key)
+	io.WriteString(m, secret)
+	return "REDACTED-" + hex.EncodeToString(m.Sum(nil)[:8])
+}
+
+// redact the headers, the URLs and the bodies of a record
+func (r *redactor) record(rec *SessionRecord) {
+	rec.URL = r.url(rec.URL)
+	rec.RewrittenURL = r.url(rec.RewrittenURL)
+	for _, h := range []http.Header{rec.ReqHeader, rec.RespHeader, rec.ReqTrailer, rec.RespTrailer} {
+		r.header(h)
+	}
+}
+
+// redact the secret headers, and the params in URL headers
+func (r *redactor) header(h http.Header) {
+	for k, values := range h {
+		if r.headers[http.CanonicalHeaderKey(k)] {
+			for i, v := range values {
+				values[i] = r.headerValue(k, v)
+			}
+		}
+	}
+	for _, k := range urlHeaders {
+		for i, v := range h[k] {
+			h[k][i] = r.url(v)
+		}
+	}
+}
+
+func (r *redactor) headerValue(name, value string) string {
+	switch http.CanonicalHeaderKey(name) {
+	case "Authorization", "Proxy-Authorization":
+		// keep the scheme, e.g. "Bearer REDACTED"
+		if scheme, credentials, ok := strings.Cut(value, " "); ok {
+			return scheme + " " + r.replace(strings.TrimSpace(credentials))
+		}
+	case "Cookie":
+		// keep the names of the cookies
+		cookies := strings.Split(value, ";")
+		for i, c := range cookies {
+			if name, v, ok := strings.Cut(c, "="); ok {
+				cookies[i] = name + "=" + r.replace(v)
+			}
+		}
+		return strings.Join(cookies, ";")
+	case "Set-Cookie":
+		// keep the name and the attributes
+		pair, attrs, _ := strings.Cut(value, ";")
+		if name, v, ok := strings.Cut(pair, "="); ok {
+			value = name + "=" + r.replace(v)
+			if attrs != "" {
+				value += ";" + attrs
+			}
+			return value
+		}
+	}
+	return r.replace(value)
+}
+
+// redact the secret params in the query and the fragment of a URL
+func (r *redactor) url(s string) string {
+	if s == "" {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	changed := false
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			u.User, changed = url.UserPassword(u.User.Username(), r.replace(password)), true
+		}
+	}
+	if q := r.query(u.RawQuery); q != u.RawQuery {
+		u.RawQuery, changed = q, true
+	}
+	if f := r.query(u.EscapedFragment()); f != u.EscapedFragment() {
+		// e.g. #access_token=... of OAuth
+		u.Fragment, _ = url.PathUnescape(f)
+		u.RawFragment, changed = f, true
+	}
+	if !changed {
+		// not re-encoded
+		return s
+	}
+	return u.String()
+}
+
+// redact the secret params of a query string or a form body, keeping the others as is
+func (r *redactor) query(q string) string {
+	if q == "" {
+		return q
+	}
+	params := strings.Split(q, "&")
+	for i, kv := range params {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		name, err := url.QueryUnescape(k)
+		if err != nil {
+			name = k
+		}
+		if r.params[strings.ToLower(name)] {
+			if value, err := url.QueryUnescape(v); err == nil {
+				v = value
+			}
+			params[i] = k + "=" + url.QueryEscape(r.replace(v))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// redact a decoded body, before it is parsed for the log and the files.
+// A body that cannot be redacted, e.g. failed to decode, is withheld.
+func (r *redactor) body(b *Body, decoded bool) {
+	b.Raw = nil
+	if !decoded || b.GRPC != nil {
+		// the secrets may be compressed or encoded; only the decoded messages are kept
+		b.Data, b.Withheld = nil, true
+		if g := b.GRPC; g != nil {
+			r.header(g.Trailer)
+			for _, m := range g.Messages {
+				m.Data = nil
+				if m.JSON != "" {
+					m.JSON = string(r.text(r.json([]byte(m.JSON))))
+				}
+				m.Wire = string(r.text([]byte(m.Wire)))
+			}
+		}
+		return
+	}
+
+	// the secret fields of a multipart body; the body is rebuilt from the redacted parts
+	redacted := false
+	for _, part := range b.Parts {
+		if part.IsField && len(part.Data) > 0 && r.params[strings.ToLower(part.Name)] {
+			part.Data = []byte(r.replace(string(part.Data)))
+			redacted = true
+		}
+		part.Data = r.text(part.Data)
+	}
+	if redacted {
+		data, err := writeMultipart(b.Parts, b.ContentType)
+		if err != nil {
+			b.Data, b.Withheld = nil, true
+			return
+		}
+		b.Data = data
+	}
+
+	// by the type the body is formatted with, as Content-Type may be missing or wrong
+	declared, _, _ := mime.ParseMediaType(b.ContentType)
+	mtype, _, _ := mime.ParseMediaType(b.Type())
+	switch {
+	case mtype == "application/x-www-form-urlencoded" || declared == "application/x-www-form-urlencoded":
+		b.Data = []byte(r.query(string(b.Data)))
+	case jsonType(mtype) || jsonType(declared):
+		b.Data = r.json(b.Data)
+	}
+	b.Data = r.text(b.Data)
+}
+
+func jsonType(mtype string) bool {
+	return mtype == "application/json" || strings.HasSuffix(mtype, "+json")
+}
+
+// redact the patterns in a text
+func (r *redactor) text(b []byte) []byte {
+	for _, re := range r.patterns {
+		if re.NumSubexp() == 0 {
+			b = re.ReplaceAllFunc(b, func(m []byte) []byte {
+				return []byte(r.replace(string(m)))
+			})
+			continue
+		}
+		// only the first group
+		var out []byte
+		last := 0
+		for _, loc := range re.FindAllSubmatchIndex(b, -1) {
+			if loc[2] < 0 {
+				continue
+			}
+			out = append(out, b[last:loc[2]]...)
+			out = append(out, r.replace(string(b[loc[2]:loc[3]]))...)
+			last = loc[3]
+		}
+		if out != nil {
+			b = append(out, b[last:]...)
+		}
+	}
+	return b
+}
+
+// a step of a JSON path
+type jsonStep struct {
+	key       string // object key. empty if an array index.
+	index     int    // array index
+	any       bool   // "*"; any key or index
+	recursive bool   // ".."; the step is at any depth
+}
+
+type jsonPath []jsonStep
+
+// parse a JSON path, e.g. "$.a.b", "$.a[0]", "$.a[*].b", "$['a b']", "$..b"
+func parseJSONPath(s string) (jp jsonPath, err error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("invalid JSON path %q; must start with $", s)
+	}
+	rest := s[1:]
+	for rest != "" {
+		var step jsonStep
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step.recursive = true
+			rest = rest[2:]
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+		case strings.HasPrefix(rest, "["):
+		default:
+			return nil, fmt.Errorf("invalid JSON path %q", s)
+		}
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSON path %q; missing ]", s)
+			}
+			sel := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case sel == "*":
+				step.any = true
+			case len(sel) >= 2 && (sel[0] == '\'' || sel[0] == '"') && sel[len(sel)-1] == sel[0]:
+				step.key = sel[1 : len(sel)-1]
+			default:
+				step.index, err = strconv.Atoi(sel)
+				if err != nil || step.index < 0 {
+					return nil, fmt.Errorf("invalid JSON path %q; invalid index %s", s, sel)
+				}
+			}
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			step.key, rest = rest[:end], rest[end:]
+			if step.key == "" {
+				return nil, fmt.Errorf("invalid JSON path %q; empty key", s)
+			}
+			step.any = step.key == "*"
+		}
+		jp = append(jp, step)
+	}
+	if len(jp) == 0 {
+		return nil, fmt.Errorf("invalid JSON path %q; the whole body", s)
+	}
+	return
+}
+
+// an element of the path of a JSON value
+type jsonElem struct {
+	key     string
+	index   int // if isIndex
+	isIndex bool
+}
+
+func (s jsonStep) matches(e jsonElem) bool {
+	if s.any {
+		return true
+	}
+	if e.isIndex {
+		return s.key == "" && s.index == e.index
+	}
+	return s.key == e.key
+}
+
+func (jp jsonPath) match(path []jsonElem) bool {
+	if len(jp) == 0 {
+		return len(path) == 0
+	}
+	s := jp[0]
+	for i := range path {
+		if s.matches(path[i]) && jp[1:].match(path[i+1:]) {
+			return true
+		}
+		if !s.recursive {
+			break
+		}
+	}
+	return false
+}
+
+// test whether a JSON value is to be redacted
+func (r *redactor) jsonSecret(path []jsonElem) bool {
+	if n := len(path); n > 0 && !path[n-1].isIndex && r.params[strings.ToLower(path[n-1].key)] {
+		return true
+	}
+	for _, jp := range r.paths {
+		if jp.match(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact the values of a JSON text matching the params or the paths.
+// The rest of the text is kept as is. An invalid JSON is returned as is.
+func (r *redactor) json(data []byte) []byte {
+	type frame struct {
+		array     bool
+		expectKey bool
+		elem      jsonElem
+	}
+	type span struct {
+		start, end int64
+		value      string // the value to be hashed; the text of the span if container
+		container  bool
+	}
+	var (
+		stack []*frame
+		spans []span
+		open  *span // a redacted object or array
+		depth int   // of open
+	)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	// a value is done; move to the next key or index
+	next := func() {
+		if n := len(stack); n > 0 {
+			if f := stack[n-1]; f.array {
+				f.elem.index++
+			} else {
+				f.expectKey = true
+			}
+		}
+	}
+	for {
+		before := dec.InputOffset()
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return data
+		}
+		if n := len(stack); n > 0 && stack[n-1].expectKey {
+			if key, ok := tok.(string); ok {
+				stack[n-1].elem.key, stack[n-1].expectKey = key, false
+				continue
+			}
+		}
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			stack = stack[:len(stack)-1]
+			if open != nil && len(stack) == depth {
+				open.end = dec.InputOffset()
+				spans = append(spans, *open)
+				open = nil
+			}
+			next()
+			continue
+		}
+
+		// a value
+		var path []jsonElem
+		for _, f := range stack {
+			path = append(path, f.elem)
+		}
+		if open == nil && len(path) > 0 && r.jsonSecret(path) {
+			// the value starts after the separators
+			start := before
+			for start < int64(len(data)) && strings.IndexByte(" \t\r\n:,", data[start]) >= 0 {
+				start++
+			}
+			s := span{start: start}
+			switch v := tok.(type) {
+			case json.Delim:
+				s.container = true
+				open, depth = &s, len(stack)
+			case string:
+				s.value, s.end = v, dec.InputOffset()
+				spans = append(spans, s)
+			default:
+				s.value, s.end = fmt.Sprint(v), dec.InputOffset()
+				spans = append(spans, s)
+			}
+		}
+		if d, ok := tok.(json.Delim); ok {
+			stack = append(stack, &frame{array: d == '[', expectKey: d == '{', elem: jsonElem{isIndex: d == '['}})
+			continue
+		}
+		next()
+	}
+	if len(spans) == 0 {
+		return data
+	}
+
+	var out bytes.Buffer
+	last := int64(0)
+	for _, s := range spans {
+		value := s.value
+		if s.container {
+			// the whole object or array
+			value = string(data[s.start:s.end])
+		}
+		quoted, _ := json.Marshal(r.replace(value))
+		out.Write(data[last:s.start])
+		out.Write(quoted)
+		last = s.end
+	}
+	out.Write(data[last:])
+	return out.Bytes()
+}
@@ -0,0 +1,165 @@
+package httpscapture
+
+//
+// Routing of sessions to separate sinks by the client
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Automatic routing of sessions, by the values of a client attribute
+const (
+	RouteByIP   = "ip"   // the client IP address
+	RouteByUser = "user" // the proxy user
+	RouteByTag  = "tag"  // the value of Options.TagHeader
+)
+
+// max number of routes made by Options.RouteBy, if not given
+const DefaultMaxRoutes = 64
+
+// A rule routing the sessions of matching clients.
+// A session matches if any of the conditions matches.
+type Route struct {
+	Name string // name of the route, e.g. the subdirectory of the sessions
+
+	Clients []*net.IPNet // client IP ranges
+	Users   []string     // proxy users
+	Tags    []string     // values of the tag header
+}
+
+func (r *Route) match(conn *Connection) bool {
+	if ip := net.ParseIP(hostName(conn.ClientAddr)); ip != nil {
+		for _, n := range r.Clients {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, u := range r.Users {
+		if conn.User != "" && conn.User == u {
+			return true
+		}
+	}
+	for _, t := range r.Tags {
+		if conn.Tag != "" && conn.Tag == t {
+			return true
+		}
+	}
+	return false
+}
+
+// the route of a session; the first matching rule, or by Options.RouteBy. empty if not routed.
+// Route names are safe as directory names.
+func (p *Proxy) route(conn *Connection) string {
+	for _, r := range p.opt.Routes {
+		if r.match(conn) {
+			return routeName(r.Name)
+		}
+	}
+	var name string
+	switch p.opt.RouteBy {
+	case RouteByIP:
+		name = routeName(hostName(conn.ClientAddr))
+	case RouteByUser:
+		name = routeName(conn.User)
+	case RouteByTag:
+		name = routeName(conn.Tag)
+	}
+	if name == "" {
+		return ""
+	}
+
+	// the clients must not make routes without limit
+	p.routeMutex.Lock()
+	defer p.routeMutex.Unlock()
+	if !p.autoRoutes[name] {
+		if len(p.autoRoutes) >= p.opt.MaxRoutes {
+			if !p.routesFull {
+				p.routesFull = true
+				p.printf("warning: more than %d routes; the sessions of new clients are not routed\n", p.opt.MaxRoutes)
+			}
+			return ""
+		}
+		if p.autoRoutes == nil {
+			p.autoRoutes = make(map[string]bool)
+		}
+		p.autoRoutes[name] = true
+	}
+	return name
+}
+
+// make a value safe as a directory name. IPv6 colons are replaced too.
+func routeName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, s)
+	if strings.Trim(s, ".") == "" {
+		// empty, "." or ".."
+		return strings.Repeat("_", len(s))
+	}
+	return s
+}
+
+// RouteSink sends sessions to the sinks of their routes (SessionRecord.Route).
+// The sinks of a route are made by New on its first session, with the route name safe as a directory name;
+// the sessions without a route are given to New("").
+type RouteSink struct {
+	New func(route string) ([]Sink, error)
+
+	mutex sync.Mutex
+	sinks map[string][]Sink
+}
+
+func (s *RouteSink) WriteSession(rec *SessionRecord) (err error) {
+	// by the directory name, so two names of a directory share its sinks
+	route := routeName(rec.Route)
+	s.mutex.Lock()
+	sinks, ok := s.sinks[route]
+	if !ok {
+		sinks, err = s.New(route)
+		if err != nil {
+			s.mutex.Unlock()
+			return
+		}
+		if s.sinks == nil {
+			s.sinks = make(map[string][]Sink)
+		}
+		s.sinks[route] = sinks
+	}
+	s.mutex.Unlock()
+
+	for _, sink := range sinks {
+		e := sink.WriteSession(rec)
+		if err == nil && e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// close the sinks of all routes
+func (s *RouteSink) Close() (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, sinks := range s.sinks {
+		for _, sink := range sinks {
+			if c, ok := sink.(io.Closer); ok {
+				e := c.Close()
+				if err == nil && e != nil {
+					err = e
+				}
+			}
+		}
+	}
+	return
+}
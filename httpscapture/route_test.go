@@ -0,0 +1,114 @@
+package httpscapture
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRouteName(t *testing.T) {
+	for s, name := range map[string]string{
+		"192.168.1.10": "192.168.1.10",
+		"::1":          "__1",
+		"alice@corp":   "alice_corp",
+		"../etc":       ".._etc",
+		"..":           "__",
+		"":             "",
+	} {
+		if n := routeName(s); n != name {
+			t.Errorf("%q: %q, expected %q", s, n, name)
+		}
+	}
+}
+
+// a sink collecting the closed sessions of a route
+type routeTestSink struct {
+	recs chan *SessionRecord
+}
+
+func (s *routeTestSink) WriteSession(rec *SessionRecord) error {
+	if rec.State == StateClosed {
+		s.recs <- rec
+	}
+	return nil
+}
+
+func TestProxyRoutes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tag["+r.Header.Get("X-Capture-Tag")+"]")
+	}))
+	defer backend.Close()
+
+	recs := make(chan *SessionRecord, 4)
+	var routes []string
+	sink := &RouteSink{New: func(route string) ([]Sink, error) {
+		routes = append(routes, route)
+		return []Sink{&routeTestSink{recs: recs}}, nil
+	}}
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	p := newTestProxy(t, Options{
+		Sinks:     []Sink{sink},
+		TagHeader: "X-Capture-Tag",
+		Routes:    []*Route{{Name: "lan", Clients: []*net.IPNet{lan}}, {Name: "qa", Tags: []string{"qa"}}},
+		RouteBy:   RouteByTag,
+	})
+	err := p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	proxyURL, _ := url.Parse("http://" + p.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	for _, c := range []struct{ tag, route string }{
+		{"qa", "qa"},
+		{"load test/1", "load_test_1"},
+		{"", ""},
+	} {
+		req, _ := http.NewRequest("GET", backend.URL, nil)
+		if c.tag != "" {
+			req.Header.Set("X-Capture-Tag", c.tag)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "tag[]" {
+			t.Errorf("the tag header is forwarded: %s", b)
+		}
+		rec := <-recs
+		if rec.Tag != c.tag || rec.Route != c.route || rec.ReqHeader.Get("X-Capture-Tag") != "" {
+			t.Errorf("%q: tag %q, route %q", c.tag, rec.Tag, rec.Route)
+		}
+	}
+	if len(routes) != 3 {
+		t.Errorf("sinks of %q are made", routes)
+	}
+	sink.WriteSession(&SessionRecord{Route: "load test/1"})
+	if len(routes) != 3 {
+		t.Errorf("sinks of %q are made", routes)
+	}
+
+	if _, err := New(Options{CACert: p.opt.CACert, CAKey: p.opt.CAKey, RouteBy: "host"}); err == nil {
+		t.Errorf("unknown routing accepted")
+	}
+	// the routes by the clients are limited
+	p.opt.MaxRoutes = 1
+	p.opt.Routes = nil
+	p.autoRoutes = nil
+	for _, c := range []struct{ tag, route string }{{"a b", "a_b"}, {"a_b", "a_b"}, {"c", ""}} {
+		if r := p.route(&Connection{Tag: c.tag}); r != c.route {
+			t.Errorf("%q: route %q, expected %q", c.tag, r, c.route)
+		}
+	}
+
+	if _, err := New(Options{CACert: p.opt.CACert, CAKey: p.opt.CAKey, Routes: []*Route{{Name: "qa", Tags: []string{"qa"}}}}); err == nil {
+		t.Errorf("routing by tag without a tag header accepted")
+	}
+}
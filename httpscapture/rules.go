@@ -0,0 +1,205 @@
+package httpscapture
+
+//
+// Filter, rewrite and block rules that can be changed at runtime
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync/atomic"
+)
+
+// rule kinds
+const (
+	RuleSave       = "save"        // save files only if the filename matches
+	RuleNoSave     = "nosave"      // do not save files if the filename matches
+	RuleSaveType   = "save-type"   // save files only if the Content-Type matches
+	RuleNoSaveType = "nosave-type" // do not save files if the Content-Type matches
+	RuleBlock      = "block"       // block requests if the URL matches
+	RuleRewrite    = "rewrite"     // rewrite the request URL
+)
+
+// A runtime rule
+type Rule struct {
+	Id      int64  `json:"id"`
+	Kind    string `json:"kind"`
+	Pattern string `json:"pattern"`           // regex, or a Content-Type for save-type and nosave-type
+	Replace string `json:"replace,omitempty"` // replacement of the URL for rewrite rules
+
+	re *regexp.Regexp
+}
+
+// Add a rule and activate it. r.Id is set to the id of the new rule.
+func (p *Proxy) AddRule(r *Rule) (err error) {
+	switch r.Kind {
+	case RuleSave, RuleNoSave, RuleBlock, RuleRewrite:
+		r.re, err = regexp.Compile(r.Pattern)
+		if err != nil {
+			return
+		}
+	case RuleSaveType, RuleNoSaveType:
+		if r.Pattern == "" {
+			return fmt.Errorf("empty content type")
+		}
+	default:
+		return fmt.Errorf("unknown rule kind: %s", r.Kind)
+	}
+
+	p.ruleMutex.Lock()
+	defer p.ruleMutex.Unlock()
+
+	p.lastRuleId++
+	r.Id = p.lastRuleId
+	p.rules[r.Id] = r
+
+	switch r.Kind {
+	case RuleSave:
+		p.saveIfMatch = append(p.saveIfMatch, r.re)
+	case RuleNoSave:
+		p.doNotSaveIfMatch = append(p.doNotSaveIfMatch, r.re)
+	case RuleSaveType:
+		if p.saveContentType == nil {
+			p.saveContentType = make(map[string]bool)
+		}
+		p.saveContentType[r.Pattern] = true
+	case RuleNoSaveType:
+		if p.doNotSaveContentType == nil {
+			p.doNotSaveContentType = make(map[string]bool)
+		}
+		p.doNotSaveContentType[r.Pattern] = true
+	case RuleBlock:
+		p.blockIfMatch = append(p.blockIfMatch, r)
+	case RuleRewrite:
+		p.rewriteRules = append(p.rewriteRules, r)
+	}
+	return
+}
+
+// Deactivate and remove a rule
+func (p *Proxy) RemoveRule(id int64) (err error) {
+	p.ruleMutex.Lock()
+	defer p.ruleMutex.Unlock()
+
+	r, ok := p.rules[id]
+	if !ok {
+		return fmt.Errorf("rule %d not found", id)
+	}
+	delete(p.rules, id)
+
+	removeRegexp := func(list []*regexp.Regexp) []*regexp.Regexp {
+		out := list[:0]
+		for _, re := range list {
+			if re != r.re {
+				out = append(out, re)
+			}
+		}
+		return out
+	}
+	removeRule := func(list []*Rule) []*Rule {
+		out := list[:0]
+		for _, x := range list {
+			if x != r {
+				out = append(out, x)
+			}
+		}
+		return out
+	}
+
+	switch r.Kind {
+	case RuleSave:
+		p.saveIfMatch = removeRegexp(p.saveIfMatch)
+	case RuleNoSave:
+		p.doNotSaveIfMatch = removeRegexp(p.doNotSaveIfMatch)
+	case RuleSaveType, RuleNoSaveType:
+		// other rules may have the same content type
+		p.rebuildContentTypes()
+	case RuleBlock:
+		p.blockIfMatch = removeRule(p.blockIfMatch)
+	case RuleRewrite:
+		p.rewriteRules = removeRule(p.rewriteRules)
+	}
+	return
+}
+
+// rebuild the content type lists from the options and the rules. must be called with ruleMutex locked.
+func (p *Proxy) rebuildContentTypes() {
+	save, doNotSave := make(map[string]bool), make(map[string]bool)
+	for _, s := range p.opt.SaveContentTypes {
+		save[s] = true
+	}
+	for _, r := range p.rules {
+		switch r.Kind {
+		case RuleSaveType:
+			save[r.Pattern] = true
+		case RuleNoSaveType:
+			doNotSave[r.Pattern] = true
+		}
+	}
+	p.saveContentType, p.doNotSaveContentType = save, doNotSave
+}
+
+// List of runtime rules, ordered by id
+func (p *Proxy) Rules() []*Rule {
+	p.ruleMutex.RLock()
+	defer p.ruleMutex.RUnlock()
+
+	list := make([]*Rule, 0, len(p.rules))
+	for _, r := range p.rules {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// test whether a request should be blocked
+func (p *Proxy) requestBlocked(req *http.Request) bool {
+	p.ruleMutex.RLock()
+	defer p.ruleMutex.RUnlock()
+
+	u := req.URL.String()
+	for _, r := range p.blockIfMatch {
+		if r.re.MatchString(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply rewrite rules to a request URL. returns nil if not rewritten.
+func (p *Proxy) rewriteURL(u *url.URL) (newURL *url.URL, err error) {
+	p.ruleMutex.RLock()
+	defer p.ruleMutex.RUnlock()
+
+	s := u.String()
+	rewritten := false
+	for _, r := range p.rewriteRules {
+		if r.re.MatchString(s) {
+			s = r.re.ReplaceAllString(s, r.Replace)
+			rewritten = true
+		}
+	}
+	if !rewritten {
+		return nil, nil
+	}
+	return url.Parse(s)
+}
+
+// Enable or disable saving bodies to files
+func (p *Proxy) SetSaveBodies(save bool) {
+	var v int32
+	if save {
+		v = 1
+	}
+	atomic.StoreInt32(&p.saveBodies, v)
+}
+
+// Whether bodies are saved to files
+func (p *Proxy) SaveBodies() bool {
+	return atomic.LoadInt32(&p.saveBodies) != 0
+}
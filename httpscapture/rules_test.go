@@ -0,0 +1,89 @@
+package httpscapture
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	var err error
+	p := newTestProxy(t, Options{})
+
+	// save rule
+	save := &Rule{Kind: RuleSave, Pattern: `\.json$`}
+	err = p.AddRule(save)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.filenameSaveable("000001_b_data.json") || p.filenameSaveable("000001_b_index.html") {
+		t.Errorf("save rule not applied")
+	}
+	err = p.RemoveRule(save.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.filenameSaveable("000001_b_index.html") {
+		t.Errorf("save rule not removed")
+	}
+
+	// content type rules of the same type
+	save1 := &Rule{Kind: RuleSaveType, Pattern: "image/png"}
+	save2 := &Rule{Kind: RuleSaveType, Pattern: "image/png"}
+	noSave := &Rule{Kind: RuleNoSaveType, Pattern: "image/png"}
+	p.AddRule(save1)
+	p.AddRule(save2)
+	p.AddRule(noSave)
+	p.RemoveRule(save1.Id)
+	p.RemoveRule(noSave.Id)
+	if !p.contentTypeSaveable("image/png") || p.contentTypeSaveable("text/html") {
+		t.Errorf("a content type rule is removed by another rule")
+	}
+	p.RemoveRule(save2.Id)
+	if !p.contentTypeSaveable("text/html") {
+		t.Errorf("save-type rule not removed")
+	}
+
+	// block rule
+	block := &Rule{Kind: RuleBlock, Pattern: `^https://ads\.`}
+	err = p.AddRule(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "https://ads.example.com/x", nil)
+	if !p.requestBlocked(req) {
+		t.Errorf("block rule not applied")
+	}
+
+	// rewrite rule
+	rewrite := &Rule{Kind: RuleRewrite, Pattern: `^https://prod\.example\.com/`, Replace: "https://staging.example.com/"}
+	err = p.AddRule(rewrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://prod.example.com/api?a=1")
+	nu, err := p.rewriteURL(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nu == nil || nu.String() != "https://staging.example.com/api?a=1" {
+		t.Errorf("rewrite rule not applied")
+	}
+
+	if len(p.Rules()) != 2 {
+		t.Errorf("invalid rule list")
+	}
+	p.RemoveRule(block.Id)
+	p.RemoveRule(rewrite.Id)
+	if p.requestBlocked(req) {
+		t.Errorf("block rule not removed")
+	}
+
+	// invalid rules
+	if p.AddRule(&Rule{Kind: "unknown", Pattern: "x"}) == nil {
+		t.Errorf("unknown rule kind accepted")
+	}
+	if p.AddRule(&Rule{Kind: RuleBlock, Pattern: "("}) == nil {
+		t.Errorf("invalid regex accepted")
+	}
+}
@@ -0,0 +1,231 @@
+package httpscapture
+
+//
+// Signer of the MITM leaf certs
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	//"github.com/elazarl/goproxy"
+	"github.com/mixcode/goproxy" // a clone of elazarl/goproxy with fixes for TLS SNI
+)
+
+// Key types of the leaf certs
+const (
+	LeafKeyECDSA = "ecdsa" // ECDSA P-256
+	LeafKeyRSA   = "rsa"   // RSA 2048 bits
+)
+
+const (
+	leafValidity = 30 * 24 * time.Hour // default validity of the leaf certs
+	leafBackdate = 24 * time.Hour      // leaf certs are valid from this duration ago, for clients with skewed clocks
+	leafRenew    = time.Hour           // a cached leaf cert is renewed if it expires in this duration
+)
+
+// signs leaf certs for the hosts by a CA, and sends them with the CA chain
+type signer struct {
+	ca    *x509.Certificate
+	key   crypto.Signer
+	certs []*x509.Certificate // the CA cert and its chain
+	chain [][]byte            // the CA cert and its chain, following the leaf in the handshakes
+
+	keyType  string        // LeafKeyECDSA or LeafKeyRSA; follows the CA key if empty
+	validity time.Duration // validity of the leaf certs; leafValidity if 0
+
+	// the cert of the server at addr to mirror, if not nil
+	upstream func(addr, serverName string) *x509.Certificate
+
+	mutex sync.Mutex
+	leaf  crypto.Signer // the key of the leaf certs
+	cache map[string]*tls.Certificate
+}
+
+// create a signer of a CA and the chain of the CA up to the root
+func newSigner(ca *x509.Certificate, key crypto.PrivateKey, chain []*x509.Certificate) (*signer, error) {
+	k, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key type %T", key)
+	}
+	s := &signer{ca: ca, key: k, cache: make(map[string]*tls.Certificate)}
+	s.certs = append([]*x509.Certificate{ca}, chain...)
+	for _, c := range s.certs {
+		s.chain = append(s.chain, c.Raw)
+	}
+	return s, nil
+}
+
+// a TLS config serving the leaf cert of the SNI, or of the host if no SNI; compatible with goproxy.TLSConfigFromCA
+func (s *signer) tlsConfig(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	serverName := hostName(host)
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := serverName
+			if hello.ServerName != "" {
+				name = hello.ServerName
+			}
+			var upstream *x509.Certificate
+			if s.upstream != nil {
+				upstream = s.upstream(host, hello.ServerName)
+			}
+			return s.sign(name, upstream)
+		},
+	}, nil
+}
+
+// a leaf cert of a host, mirroring the server cert if not nil, from the cache if not expiring
+func (s *signer) sign(host string, upstream *x509.Certificate) (*tls.Certificate, error) {
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if !s.permits(host) {
+		// the client would reject the cert
+		return nil, fmt.Errorf("%s is outside the name constraints of the CA", host)
+	}
+	cacheKey := host
+	if upstream != nil {
+		sum := sha256.Sum256(upstream.Raw)
+		cacheKey += " " + hex.EncodeToString(sum[:])
+	}
+	now := time.Now()
+	s.mutex.Lock()
+	c := s.cache[cacheKey]
+	s.mutex.Unlock()
+	// a mirrored cert is kept as the server cert is, even if expiring
+	if c != nil && (upstream != nil || now.Add(leafRenew).Before(c.Leaf.NotAfter)) {
+		return c, nil
+	}
+
+	c, err := s.newLeaf(host, upstream, now)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.cache[cacheKey] = c
+	s.mutex.Unlock()
+	return c, nil
+}
+
+// the key of the leaf certs, generated once
+func (s *signer) leafKey() (crypto.Signer, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.leaf != nil {
+		return s.leaf, nil
+	}
+	keyType := s.keyType
+	if keyType == "" {
+		// follow the type of the CA key
+		keyType = LeafKeyECDSA
+		if _, ok := s.key.(*rsa.PrivateKey); ok {
+			keyType = LeafKeyRSA
+		}
+	}
+	var err error
+	switch keyType {
+	case LeafKeyRSA:
+		s.leaf, err = rsa.GenerateKey(rand.Reader, 2048)
+	case LeafKeyECDSA:
+		s.leaf, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		err = fmt.Errorf("unknown leaf key type: %s", keyType)
+	}
+	return s.leaf, err
+}
+
+func (s *signer) newLeaf(host string, upstream *x509.Certificate, now time.Time) (*tls.Certificate, error) {
+	key, err := s.leafKey()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	validity := s.validity
+	if validity == 0 {
+		validity = leafValidity
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host, Organization: []string{"https_capture MITM proxy"}},
+		NotBefore:             now.Add(-leafBackdate),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	if upstream != nil {
+		s.mirror(template, upstream)
+	}
+	// a leaf must not outlive the CA, e.g. a short-lived intermediate
+	if template.NotAfter.After(s.ca.NotAfter) {
+		template.NotAfter = s.ca.NotAfter
+	}
+	if template.NotBefore.Before(s.ca.NotBefore) {
+		template.NotBefore = s.ca.NotBefore
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca, key.Public(), s.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: append([][]byte{der}, s.chain...),
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// copy the subject, the SANs and the validity of a server cert to a leaf template.
+// Names outside the name constraints of the CA are dropped, or the client would reject the whole cert.
+func (s *signer) mirror(template, upstream *x509.Certificate) {
+	template.RawSubject = upstream.RawSubject
+	template.NotBefore, template.NotAfter = upstream.NotBefore, upstream.NotAfter
+
+	var dnsNames []string
+	var ips []net.IP
+	for _, name := range upstream.DNSNames {
+		if s.permits(name) {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	for _, ip := range upstream.IPAddresses {
+		if s.permits(ip.String()) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(dnsNames)+len(ips) == 0 {
+		// keep the requested host
+		return
+	}
+	template.DNSNames, template.IPAddresses = dnsNames, ips
+	if !s.constrained() {
+		template.EmailAddresses, template.URIs = upstream.EmailAddresses, upstream.URIs
+	}
+}
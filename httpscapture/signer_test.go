@@ -0,0 +1,224 @@
+package httpscapture
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// create a CA cert signed by parent, or a self-signed root if parent is nil
+func testCA(t *testing.T, cn string, notAfter time.Time, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestSigner(t *testing.T) {
+	root, rootKey := testCA(t, "test root", time.Now().Add(24*time.Hour), nil, nil)
+	ca, caKey := testCA(t, "test intermediate", time.Now().Add(2*time.Hour), root, rootKey)
+
+	s, err := newSigner(ca, caKey, []*x509.Certificate{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.sign("Example.COM", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Certificate) != 3 {
+		t.Fatalf("the chain is not sent: %d certs", len(c.Certificate))
+	}
+	// the leaf does not outlive the intermediate
+	if !c.Leaf.NotAfter.Equal(ca.NotAfter) {
+		t.Errorf("leaf expires at %v, after the CA", c.Leaf.NotAfter)
+	}
+	if c2, _ := s.sign("example.com", nil); c2 != c {
+		t.Errorf("leaf not cached")
+	}
+
+	if _, err := newSigner(ca, "key", nil); err == nil {
+		t.Errorf("invalid key accepted")
+	}
+}
+
+func TestProxyIntermediate(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+
+	// the client trusts the root only
+	root, rootKey := testCA(t, "test root", time.Now().Add(24*time.Hour), nil, nil)
+	ca, caKey := testCA(t, "test intermediate", time.Now().Add(time.Hour), root, rootKey)
+	p, err := New(Options{Addr: "127.0.0.1:0", CACert: ca, CAKey: caKey, CAChain: []*x509.Certificate{root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	proxyURL, _ := url.Parse("http://" + p.Addr().String())
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if chain := resp.TLS.VerifiedChains[0]; len(chain) != 3 || !chain[2].Equal(root) {
+		t.Errorf("invalid verified chain of %d certs", len(chain))
+	}
+}
+
+func TestLeafOptions(t *testing.T) {
+	// a P-521 CA, as the built-in one
+	key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test P-521 CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	for _, keyType := range []string{"", LeafKeyECDSA, LeafKeyRSA} {
+		s, err := newSigner(ca, key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.keyType, s.validity = keyType, 2*time.Hour
+		c, err := s.sign("example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch pub := c.Leaf.PublicKey.(type) {
+		case *ecdsa.PublicKey:
+			if keyType == LeafKeyRSA || pub.Curve != elliptic.P256() {
+				t.Errorf("%q: invalid leaf key %s", keyType, pub.Curve.Params().Name)
+			}
+		case *rsa.PublicKey:
+			if keyType != LeafKeyRSA || pub.N.BitLen() != 2048 {
+				t.Errorf("%q: invalid RSA leaf key", keyType)
+			}
+		}
+		if d := c.Leaf.NotAfter.Sub(time.Now()); d > 2*time.Hour || d < time.Hour {
+			t.Errorf("invalid validity: expires in %v", d)
+		}
+	}
+
+	// mirror a server cert, dropping the names outside the constraints
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	cca, ckey := constrainedCA(t, []string{"example.com"}, []*net.IPNet{lan})
+	s, err := newSigner(cca, ckey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "www.example.com", Organization: []string{"Example Inc."}, Country: []string{"US"}},
+		DNSNames:    []string{"www.example.com", "*.example.com", "example.org"},
+		IPAddresses: []net.IP{net.ParseIP("10.1.1.1"), net.ParseIP("192.168.1.1")},
+		NotBefore:   time.Now().Add(-48 * time.Hour),
+		NotAfter:    time.Now().Add(30 * time.Minute),
+	}
+	upstream.RawSubject, _ = asn1.Marshal(upstream.Subject.ToRDNSequence())
+	c, err := s.sign("www.example.com", upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := c.Leaf
+	if leaf.Subject.String() != upstream.Subject.String() ||
+		strings.Join(leaf.DNSNames, ",") != "www.example.com,*.example.com" ||
+		len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(upstream.IPAddresses[0]) ||
+		!leaf.NotAfter.Equal(upstream.NotAfter.Truncate(time.Second)) {
+		t.Errorf("not mirrored: %s %v %v %v", leaf.Subject, leaf.DNSNames, leaf.IPAddresses, leaf.NotAfter)
+	}
+	// the mirrored cert is kept even if expiring
+	if c2, _ := s.sign("www.example.com", upstream); c2 != c {
+		t.Errorf("mirrored leaf not cached")
+	}
+}
+
+func TestProxyMirrorUpstream(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+
+	p := newTestProxy(t, Options{MirrorUpstream: true, LeafKey: LeafKeyRSA})
+	err := p.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	resp, err := proxyClient(p, false).Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	leaf, server := resp.TLS.PeerCertificates[0], backend.Certificate()
+	if leaf.Subject.String() != server.Subject.String() || strings.Join(leaf.DNSNames, ",") != strings.Join(server.DNSNames, ",") {
+		t.Errorf("server cert not mirrored: %s %v", leaf.Subject, leaf.DNSNames)
+	}
+	if _, ok := leaf.PublicKey.(*rsa.PublicKey); !ok {
+		t.Errorf("leaf key is not RSA")
+	}
+
+	if _, err := New(Options{CACert: p.opt.CACert, CAKey: p.opt.CAKey, LeafKey: "dsa"}); err == nil {
+		t.Errorf("unknown leaf key type accepted")
+	}
+}
@@ -0,0 +1,35 @@
+package httpscapture
+
+//
+// Sinks of captured sessions
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"fmt"
+)
+
+// A Sink receives snapshots of captured sessions
+//
+// If a Sink also implements io.Closer, it is closed when the proxy is closed.
+type Sink interface {
+	// WriteSession is called when a session is started, got a response, and closed, failed or blocked.
+	// The record must not be modified.
+	WriteSession(rec *SessionRecord) error
+}
+
+// An error returned by a sink.
+// Sink errors are reported by Proxy.Errors(), and do not stop the other sinks.
+type SinkError struct {
+	Sink Sink
+	Err  error
+}
+
+func (e *SinkError) Error() string {
+	return fmt.Sprintf("sink %T: %v", e.Sink, e.Err)
+}
+
+func (e *SinkError) Unwrap() error {
+	return e.Err
+}
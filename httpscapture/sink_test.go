@@ -0,0 +1,93 @@
+package httpscapture
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type failingSink struct{}
+
+func (failingSink) WriteSession(rec *SessionRecord) error {
+	return errors.New("failed")
+}
+
+func testRecord() *SessionRecord {
+	start := time.Date(2021, 4, 28, 5, 55, 12, 0, time.UTC)
+	return &SessionRecord{
+		Id: 1, State: StateClosed,
+		Start: start, RespStart: start.Add(10 * time.Millisecond), End: start.Add(30 * time.Millisecond),
+		Method: "POST", Host: "example.com", URL: "https://example.com/api?a=1", Path: "/api",
+		Status: "200 OK", StatusCode: 200,
+		ReqHeader:   http.Header{"Content-Type": {"application/json"}, "Cookie": {"k=v"}},
+		RespHeader:  http.Header{"Content-Type": {"image/png"}},
+		RespTrailer: http.Header{"X-Checksum": {"1234"}},
+		ReqBody:     &Body{Data: []byte(`{"x":1}`), ContentType: "application/json", IsText: true},
+		RespBody:    &Body{Data: []byte{0x89, 'P', 'N', 'G', 0xff}, ContentType: "image/png", File: "000001_b_x.png"},
+	}
+}
+
+func TestSinks(t *testing.T) {
+	var text, jsonl, har bytes.Buffer
+	harSink := &HARSink{W: &har}
+	p := newTestProxy(t, Options{Sinks: []Sink{
+		failingSink{},
+		&TextSink{W: &text},
+		&JSONLSink{W: &jsonl, Bodies: true},
+		harSink,
+	}})
+
+	p.publish(testRecord())
+
+	// the failing sink is reported
+	select {
+	case err := <-p.Errors():
+		var sinkErr *SinkError
+		if !errors.As(err, &sinkErr) {
+			t.Errorf("not a sink error: %v", err)
+		}
+	default:
+		t.Errorf("sink error not reported")
+	}
+
+	// the other sinks are not stopped
+	if !strings.Contains(text.String(), "(saved to 000001_b_x.png)") || !strings.Contains(text.String(), "==== Resp: trailers ====\n\t\tX-Checksum: [1234]") {
+		t.Errorf("invalid text log: %s", text.String())
+	}
+
+	var j map[string]interface{}
+	err := json.Unmarshal(jsonl.Bytes(), &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j["id"].(float64) != 1 || j["reqBodyData"].(string) != "eyJ4IjoxfQ==" {
+		t.Errorf("invalid JSONL: %s", jsonl.String())
+	}
+
+	err = harSink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h harLog
+	err = json.Unmarshal(har.Bytes(), &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Log.Entries) != 1 {
+		t.Fatalf("invalid HAR entries")
+	}
+	e := h.Log.Entries[0]
+	if e.Time != 30 || e.Timings.Wait != 10 || e.Timings.Receive != 20 {
+		t.Errorf("invalid HAR timings: %v", e.Timings)
+	}
+	if e.Request.PostData.Text != `{"x":1}` || len(e.Request.Cookies) != 1 || len(e.Request.QueryString) != 1 {
+		t.Errorf("invalid HAR request")
+	}
+	if e.Response.StatusText != "OK" || e.Response.Content.Encoding != "base64" || len(e.Response.Trailers) != 1 {
+		t.Errorf("invalid HAR response")
+	}
+}
@@ -0,0 +1,127 @@
+package httpscapture
+
+//
+// Content sniffing by magic numbers
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"unicode/utf8"
+)
+
+// magic numbers not known to (or to be preferred over) http.DetectContentType
+var sniffSignatures = []struct {
+	offset int
+	magic  []byte
+	ctype  string
+}{
+	{0, []byte("\x00asm"), "application/wasm"},
+	{0, []byte("wOF2"), "font/woff2"},
+	{0, []byte("wOFF"), "font/woff"},
+	{0, []byte("PK\x03\x04"), "application/zip"},
+	{0, []byte("PK\x05\x06"), "application/zip"}, // an empty archive
+	{8, []byte("WEBP"), "image/webp"},            // "RIFF" size "WEBP"
+}
+
+// guess the Content-Type of a body from its content
+func sniffContentType(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	for _, s := range sniffSignatures {
+		if len(data) >= s.offset+len(s.magic) && bytes.Equal(data[s.offset:s.offset+len(s.magic)], s.magic) {
+			return s.ctype
+		}
+	}
+
+	// JSON
+	t := bytes.TrimLeft(data, " \t\r\n")
+	if len(t) > 0 && (t[0] == '{' || t[0] == '[') && json.Valid(data) {
+		return "application/json"
+	}
+
+	ct := http.DetectContentType(data)
+	if ct == "application/octet-stream" && looksLikeProtobuf(data) {
+		return "application/x-protobuf"
+	}
+	return ct
+}
+
+// test whether data is a binary protobuf message
+func looksLikeProtobuf(data []byte) bool {
+	// a text is more likely if valid in UTF-8
+	return !utf8.Valid(data) && validWireFormat(data)
+}
+
+// test whether data is a valid sequence of protobuf wire format fields
+func validWireFormat(data []byte) bool {
+	fields := 0
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return false
+		}
+		data = data[n:]
+		fieldNum, wireType := tag>>3, tag&7
+		if fieldNum == 0 || fieldNum > 1<<29-1 {
+			return false
+		}
+		switch wireType {
+		case 0: // varint
+			_, n = binary.Uvarint(data)
+			if n <= 0 {
+				return false
+			}
+			data = data[n:]
+		case 1: // 64-bit
+			if len(data) < 8 {
+				return false
+			}
+			data = data[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return false
+			}
+			data = data[n+int(l):]
+		case 5: // 32-bit
+			if len(data) < 4 {
+				return false
+			}
+			data = data[4:]
+		default: // groups are deprecated
+			return false
+		}
+		fields++
+	}
+	return fields > 0
+}
+
+// test whether the declared Content-Type and the sniffed one disagree
+func contentTypeMismatch(declared, sniffed string) bool {
+	if declared == "" || sniffed == "" {
+		return false
+	}
+	d, _, e1 := mime.ParseMediaType(declared)
+	s, _, e2 := mime.ParseMediaType(sniffed)
+	if e1 != nil || e2 != nil || d == s {
+		return false
+	}
+	if d == "application/octet-stream" {
+		// no declaration at all
+		return false
+	}
+	_, _, _, dText, _ := mediaType(declared)
+	_, _, _, sText, _ := mediaType(sniffed)
+	if s == "text/plain" || s == "application/octet-stream" {
+		// the sniffer knows only whether it's a text or not
+		return dText != sText
+	}
+	return true
+}
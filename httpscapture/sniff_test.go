@@ -0,0 +1,48 @@
+package httpscapture
+
+import (
+	"testing"
+)
+
+func TestSniffContentType(t *testing.T) {
+	cases := []struct {
+		data  string
+		ctype string
+	}{
+		{"\x00asm\x01\x00\x00\x00", "application/wasm"},
+		{"wOF2\x00\x01\x00\x00", "font/woff2"},
+		{"PK\x03\x04\x14\x00", "application/zip"},
+		{"RIFF\x24\x00\x00\x00WEBPVP8 ", "image/webp"},
+		{"\x89PNG\x0d\x0a\x1a\x0a", "image/png"},
+		{` {"a": [1, 2]}`, "application/json"},
+		{`{"a": broken`, "text/plain; charset=utf-8"},
+		{"\x08\x96\x01\x12\x04\xff\xfe\xfd\xfc", "application/x-protobuf"}, // 1: 150, 2: bytes
+		{"\x08\x96", "application/octet-stream"},                           // truncated varint
+		{"<html><body>", "text/html; charset=utf-8"},
+	}
+	for _, c := range cases {
+		if ct := sniffContentType([]byte(c.data)); ct != c.ctype {
+			t.Errorf("%q: expected %s, got %s", c.data, c.ctype, ct)
+		}
+	}
+}
+
+func TestContentTypeMismatch(t *testing.T) {
+	cases := []struct {
+		declared, sniffed string
+		mismatch          bool
+	}{
+		{"image/jpeg", "image/webp", true},
+		{"text/html; charset=utf-8", "image/png", true},
+		{"text/html", "text/html; charset=utf-8", false},
+		{"application/json", "text/plain; charset=utf-8", false}, // both texts
+		{"text/plain", "application/octet-stream", true},         // a binary declared as a text
+		{"application/octet-stream", "application/zip", false},   // no declaration
+		{"", "application/zip", false},
+	}
+	for _, c := range cases {
+		if m := contentTypeMismatch(c.declared, c.sniffed); m != c.mismatch {
+			t.Errorf("%s vs %s: expected %v", c.declared, c.sniffed, c.mismatch)
+		}
+	}
+}
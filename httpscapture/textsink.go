@@ -0,0 +1,280 @@
+package httpscapture
+
+//
+// A sink writing sessions to a text log
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TextSink writes sessions to a human-readable text log
+type TextSink struct {
+	W           io.Writer // the log output
+	RawPostForm bool      // log x-www-form-urlencoded in raw query string
+
+	mutex  sync.Mutex
+	failed bool // the log output failed
+}
+
+func (s *TextSink) WriteSession(rec *SessionRecord) (err error) {
+	l := newLog()
+
+	switch rec.State {
+	case StateRequest:
+		l.writef("%s [%d] start_req %s %s (%s)\n", timestamp(), rec.Id, rec.Method, rec.URL, rec.Host)
+		if rec.RewrittenURL != "" {
+			l.writef("\t(rewritten to %s)\n", rec.RewrittenURL)
+		}
+
+	case StateResponse:
+		l.writef("%s [%d] open_resp (%s) %s %s\n", timestamp(), rec.Id, rec.Status, rec.Method, rec.URL)
+
+	case StateBlocked:
+		l.writef("%s [%d] blocked %s %s\n", timestamp(), rec.Id, rec.Method, rec.URL)
+
+	case StateFailed:
+		// HTTP error happened
+		l.writef("%s [%d] failed (%v) %s %s\n", timestamp(), rec.Id, rec.Error, rec.Method, rec.URL)
+		if rec.Timings != nil {
+			l.writef("\ttimings: %s\n", rec.Timings)
+		}
+
+	case StateClosed:
+		err = s.writeClosed(l, rec)
+	}
+
+	e := s.flush(l)
+	if err == nil {
+		err = e
+	}
+	return
+}
+
+// write a closed session
+func (s *TextSink) writeClosed(l *hlog, rec *SessionRecord) (err error) {
+
+	// print the connection info
+	l.writef("%s [%d] close_resp (%s) %s %s\n", timestamp(), rec.Id, rec.Status, rec.Method, rec.URL)
+	if rec.Timings != nil {
+		l.writef("\ttimings: %s\n", rec.Timings)
+	}
+	s.writeTLS(l, rec)
+
+	// write request headers
+	l.writef("\t==== Req (%s): headers ====\n", rec.Proto)
+	for k, v := range rec.ReqHeader {
+		l.writef("\t\t%s: %v\n", k, v)
+	}
+
+	// write the request body
+	if rec.ReqBody != nil {
+		l.writef("\t---- Req: body ----\n")
+		err = s.writeBody(l, rec.ReqBody, "\t\t")
+		if err != nil {
+			return
+		}
+	}
+	if len(rec.ReqTrailer) > 0 {
+		l.writef("\t==== Req: trailers ====\n")
+		for k, v := range rec.ReqTrailer {
+			l.writef("\t\t%s: %v\n", k, v)
+		}
+	}
+
+	// write response headers
+	l.writef("\t==== Resp (%s %s): headers ====\n", rec.UpstreamProto, rec.Status)
+	for k, v := range rec.RespHeader {
+		l.writef("\t\t%s: %v\n", k, v)
+	}
+
+	// Write the response body
+	if rec.RespBody != nil {
+		l.writef("\t---- Resp: body ----\n")
+		err = s.writeBody(l, rec.RespBody, "\t\t")
+		if err != nil {
+			return
+		}
+	}
+	if len(rec.RespTrailer) > 0 {
+		l.writef("\t==== Resp: trailers ====\n")
+		for k, v := range rec.RespTrailer {
+			l.writef("\t\t%s: %v\n", k, v)
+		}
+	}
+	l.writef("\n") // a blank line to improve readability
+	return
+}
+
+// write a body inline, or the name of the saved file
+func (s *TextSink) writeBody(l *hlog, b *Body, indent string) (err error) {
+	if b.TypeMismatch {
+		l.writef("%s(Content-Type is %s, but the body looks like %s)\n", indent, b.ContentType, b.SniffedType)
+	}
+	if b.DecodeError != "" {
+		l.writef("%s(content decoding failed: %s; the raw body is kept)\n", indent, b.DecodeError)
+	}
+	if b.Withheld {
+		l.writef("%s(withheld; the body cannot be redacted)\n", indent)
+	}
+	if b.RawFile != "" {
+		l.writef("%s(raw %s body saved to %s)\n", indent, b.Encoding, b.RawFile)
+	}
+	if b.UTF8File != "" {
+		l.writef("%s(%s text transcoded to UTF-8, saved to %s)\n", indent, b.Charset, b.UTF8File)
+	}
+	if b.Inline {
+		text := b.Pretty
+		if text == nil && b.ContentType == "application/x-www-form-urlencoded" && !s.RawPostForm {
+			text = formLines(b.Text())
+		}
+		if text != nil {
+			for _, line := range strings.Split(strings.TrimSuffix(string(text), "\n"), "\n") {
+				l.writef("%s%s\n", indent, line)
+			}
+		} else {
+			l.writef("%s%s\n", indent, b.Text())
+		}
+		return
+	}
+
+	if b.File != "" {
+		l.writef("%s(saved to %s)\n", indent, b.File)
+	}
+	if g := b.GRPC; g != nil {
+		s.writeGRPC(l, g, indent)
+	}
+	for _, part := range b.Parts {
+		if part.IsField {
+			value := strings.ReplaceAll(string(part.Data), "\n", "\n"+indent+"\t")
+			l.writef("%spart%d %s=%s\n", indent, part.Index, part.Name, value)
+		} else if part.File != "" {
+			l.writef("%spart%d %s: %q (%s, %d bytes) saved to %s\n", indent, part.Index, part.Name, part.FileName, part.ContentType, part.Size, part.File)
+		}
+	}
+	if b.PrettyFile != "" {
+		l.writef("%s(pretty-printed to %s)\n", indent, b.PrettyFile)
+	}
+	return
+}
+
+// write the TLS parameters of the client and the server
+func (s *TextSink) writeTLS(l *hlog, rec *SessionRecord) {
+	if rec.ClientAddr != "" {
+		l.writef("\tclient: %s", rec.ClientAddr)
+		if rec.User != "" {
+			l.writef(", user %s", rec.User)
+		}
+		l.writef("\n")
+	}
+	if rec.Tag != "" {
+		l.writef("\ttag: %s\n", rec.Tag)
+	}
+	if h := rec.ClientHello; h != nil {
+		l.writef("\tclient TLS: sni %q, versions %v, alpn %v\n", h.ServerName, h.Versions, h.ALPN)
+		l.writef("\t\tja3 %s, ja4 %s\n", h.JA3Hash, h.JA4)
+	}
+	for i, c := range rec.ClientCerts {
+		l.writef("\t\tclient cert %d: %s (issuer %s), sha256 %s\n", i, c.Subject, c.Issuer, c.SHA256)
+	}
+	t := rec.UpstreamTLS
+	if t == nil {
+		if rec.ServerAddr != "" {
+			l.writef("\tserver: %s\n", rec.ServerAddr)
+		}
+		return
+	}
+	l.writef("\tserver: %s, %s, %s", rec.ServerAddr, t.Version, t.CipherSuite)
+	if t.ALPN != "" {
+		l.writef(", alpn %s", t.ALPN)
+	}
+	if t.OCSP != "" {
+		l.writef(", ocsp %s", t.OCSP)
+	}
+	l.writef("\n")
+	if t.VerifyError != "" {
+		l.writef("\t\t(certificate verification failed: %s)\n", t.VerifyError)
+	}
+	for i, c := range t.Certificates {
+		l.writef("\t\tcert %d: %s (issuer %s) %s - %s, sha256 %s\n", i, c.Subject, c.Issuer,
+			c.NotBefore.Format(time.RFC3339), c.NotAfter.Format(time.RFC3339), c.SHA256)
+		if len(c.DNSNames) > 0 || len(c.IPAddresses) > 0 {
+			l.writef("\t\t\tSAN %v\n", append(append([]string{}, c.DNSNames...), c.IPAddresses...))
+		}
+	}
+}
+
+// write gRPC messages
+func (s *TextSink) writeGRPC(l *hlog, g *GRPC, indent string) {
+	for i, m := range g.Messages {
+		l.writef("%sgrpc message %d (%d bytes", indent, i+1, m.Size)
+		if m.Compressed {
+			l.writef(", compressed")
+		}
+		l.writef(")\n")
+		if m.Error != "" {
+			l.writef("%s\t(%s)\n", indent, m.Error)
+		}
+		text := m.JSON
+		if text == "" {
+			text = m.Wire
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+			if line != "" {
+				l.writef("%s\t%s\n", indent, line)
+			}
+		}
+	}
+	if g.Error != "" {
+		l.writef("%s(grpc framing error: %s)\n", indent, g.Error)
+	}
+	if g.Status != "" {
+		l.writef("%sgrpc-status: %s %s\n", indent, g.Status, g.Message)
+	}
+}
+
+// write a log chunk to the output
+func (s *TextSink) flush(l *hlog) (err error) {
+	buf := l.b.Bytes()
+	if len(buf) == 0 || s.W == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failed {
+		return
+	}
+	_, err = s.W.Write(buf)
+	if err != nil {
+		s.failed = true
+	}
+	return
+}
+
+// a log chunk of a session
+type hlog struct {
+	b *bytes.Buffer
+}
+
+func newLog() *hlog {
+	return &hlog{b: &bytes.Buffer{}}
+}
+
+func (l *hlog) Write(p []byte) (n int, err error) {
+	return l.b.Write(p)
+}
+
+func (l *hlog) writef(format string, arg ...interface{}) {
+	fmt.Fprintf(l.b, format, arg...)
+}
+
+func timestamp() string {
+	return time.Now().Format(time.RFC3339)
+}
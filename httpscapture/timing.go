@@ -0,0 +1,135 @@
+package httpscapture
+
+//
+// Timing breakdown of the upstream round trips
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timings of the upstream round trip, measured by httptrace.
+// A step not taken (e.g. DNS and connect on a reused connection) is zero.
+// Durations are in nanoseconds in JSON.
+type Timings struct {
+	Blocked time.Duration `json:"blocked"` // waiting for a connection
+	DNS     time.Duration `json:"dns"`
+	Connect time.Duration `json:"connect"` // TCP connect
+	TLS     time.Duration `json:"tls"`     // TLS handshake
+	Send    time.Duration `json:"send"`    // writing the request
+	Wait    time.Duration `json:"wait"`    // time to the first byte of the response, after the request is written
+	Receive time.Duration `json:"receive"` // transfer of the response body
+
+	Reused bool `json:"reused,omitempty"` // an idle connection is reused
+}
+
+func (t *Timings) String() string {
+	ms := func(d time.Duration) string {
+		return fmt.Sprintf("%.3fms", float64(d)/float64(time.Millisecond))
+	}
+	s := []string{}
+	if t.Reused {
+		s = append(s, "reused connection")
+	} else {
+		s = append(s, "dns "+ms(t.DNS), "connect "+ms(t.Connect), "tls "+ms(t.TLS))
+	}
+	s = append(s, "blocked "+ms(t.Blocked), "send "+ms(t.Send), "wait "+ms(t.Wait), "receive "+ms(t.Receive))
+	return strings.Join(s, ", ")
+}
+
+// events of a round trip. the callbacks may be called from other goroutines.
+type upstreamTrace struct {
+	mutex sync.Mutex
+
+	getConn, gotConn    time.Time
+	dnsStart, dnsDone   time.Time
+	connStart, connDone time.Time
+	tlsStart, tlsDone   time.Time
+	wrote, firstByte    time.Time
+	reused              bool
+	remoteAddr          string
+}
+
+func (t *upstreamTrace) event(at *time.Time) {
+	t.mutex.Lock()
+	if at.IsZero() {
+		*at = time.Now()
+	}
+	t.mutex.Unlock()
+}
+
+func (t *upstreamTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) { t.event(&t.getConn) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mutex.Lock()
+			t.reused = info.Reused
+			t.remoteAddr = info.Conn.RemoteAddr().String()
+			t.mutex.Unlock()
+			t.event(&t.gotConn)
+		},
+		DNSStart:     func(httptrace.DNSStartInfo) { t.event(&t.dnsStart) },
+		DNSDone:      func(httptrace.DNSDoneInfo) { t.event(&t.dnsDone) },
+		ConnectStart: func(string, string) { t.event(&t.connStart) },
+		ConnectDone: func(string, string, error) {
+			// the last attempt, if dialed to multiple addresses
+			t.mutex.Lock()
+			t.connDone = time.Now()
+			t.mutex.Unlock()
+		},
+		TLSHandshakeStart:    func() { t.event(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.event(&t.tlsDone) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.event(&t.wrote) },
+		GotFirstResponseByte: func() { t.event(&t.firstByte) },
+	}
+}
+
+// the server address connected
+func (t *upstreamTrace) serverAddr() string {
+	if t == nil {
+		return ""
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.remoteAddr
+}
+
+// the timings of a round trip ended at end. nil if the request has not been sent.
+func (t *upstreamTrace) timings(end time.Time) *Timings {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.getConn.IsZero() {
+		return nil
+	}
+
+	// duration between two events, if both happened
+	span := func(from, to time.Time) time.Duration {
+		if from.IsZero() || to.IsZero() || to.Before(from) {
+			return 0
+		}
+		return to.Sub(from)
+	}
+	tm := &Timings{
+		DNS:     span(t.dnsStart, t.dnsDone),
+		Connect: span(t.connStart, t.connDone),
+		TLS:     span(t.tlsStart, t.tlsDone),
+		Send:    span(t.gotConn, t.wrote),
+		Wait:    span(t.wrote, t.firstByte),
+		Receive: span(t.firstByte, end),
+		Reused:  t.reused,
+	}
+	if blocked := span(t.getConn, t.gotConn) - tm.DNS - tm.Connect - tm.TLS; blocked > 0 {
+		tm.Blocked = blocked
+	}
+	return tm
+}
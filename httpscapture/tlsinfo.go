@@ -0,0 +1,380 @@
+package httpscapture
+
+//
+// TLS parameters of the upstream servers, and ClientHello of the clients
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/ocsp"
+)
+
+// TLS parameters of a connection to a server
+type TLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipherSuite"`
+	ALPN        string `json:"alpn,omitempty"`
+	ServerName  string `json:"serverName,omitempty"`
+
+	// status of the stapled OCSP response; "good", "revoked", "unknown", or a parse error. empty if not stapled.
+	OCSP string `json:"ocsp,omitempty"`
+
+	Certificates []*CertInfo `json:"certificates"` // the chain presented by the server, leaf first
+
+	VerifyError string `json:"verifyError,omitempty"` // the reason the chain is not valid, if verified
+}
+
+// Summary of a certificate
+type CertInfo struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	DNSNames    []string  `json:"dnsNames,omitempty"`
+	IPAddresses []string  `json:"ipAddresses,omitempty"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	SHA256      string    `json:"sha256"` // fingerprint of the certificate
+}
+
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	if state == nil {
+		return nil
+	}
+	t := &TLSInfo{
+		Version:      tls.VersionName(state.Version),
+		CipherSuite:  tls.CipherSuiteName(state.CipherSuite),
+		ALPN:         state.NegotiatedProtocol,
+		ServerName:   state.ServerName,
+		Certificates: []*CertInfo{},
+	}
+	for _, c := range state.PeerCertificates {
+		t.Certificates = append(t.Certificates, newCertInfo(c))
+	}
+	if len(state.OCSPResponse) > 0 {
+		var issuer *x509.Certificate
+		if len(state.PeerCertificates) > 1 {
+			issuer = state.PeerCertificates[1]
+		}
+		r, err := ocsp.ParseResponse(state.OCSPResponse, issuer)
+		switch {
+		case err != nil:
+			t.OCSP = err.Error()
+		case r.Status == ocsp.Good:
+			t.OCSP = "good"
+		case r.Status == ocsp.Revoked:
+			t.OCSP = "revoked"
+		default:
+			t.OCSP = "unknown"
+		}
+	}
+	return t
+}
+
+func newCertInfo(c *x509.Certificate) *CertInfo {
+	sum := sha256.Sum256(c.Raw)
+	info := &CertInfo{
+		Subject:   c.Subject.String(),
+		Issuer:    c.Issuer.String(),
+		DNSNames:  c.DNSNames,
+		NotBefore: c.NotBefore,
+		NotAfter:  c.NotAfter,
+		SHA256:    hex.EncodeToString(sum[:]),
+	}
+	for _, ip := range c.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	return info
+}
+
+// TLS ClientHello of a client
+type ClientHello struct {
+	ServerName   string   `json:"serverName,omitempty"` // SNI
+	Versions     []string `json:"versions"`             // offered TLS versions
+	CipherSuites []string `json:"cipherSuites"`
+	ALPN         []string `json:"alpn,omitempty"`
+
+	JA3     string `json:"ja3"`     // JA3 fingerprint string
+	JA3Hash string `json:"ja3Hash"` // MD5 of the JA3 string
+	JA4     string `json:"ja4"`     // JA4 fingerprint
+}
+
+// TLS extensions used for fingerprints
+const (
+	extServerName          = 0
+	extSupportedGroups     = 10
+	extECPointFormats      = 11
+	extSignatureAlgorithms = 13
+	extALPN                = 16
+	extSupportedVersions   = 43
+)
+
+// test whether a value is a GREASE value (RFC 8701), ignored in fingerprints
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// join the handshake fragments of TLS records into the first handshake message.
+// complete is true if the message is complete, or the data is not of handshake records.
+func handshakeMessage(data []byte) (msg []byte, complete bool) {
+	for len(data) >= 5 {
+		if data[0] != 22 { // not a handshake record
+			return msg, true
+		}
+		n := int(data[3])<<8 | int(data[4])
+		if len(data) < 5+n {
+			break
+		}
+		msg = append(msg, data[5:5+n]...)
+		data = data[5+n:]
+		if len(msg) >= 4 && len(msg) >= 4+(int(msg[1])<<16|int(msg[2])<<8|int(msg[3])) {
+			return msg, true
+		}
+	}
+	return msg, false
+}
+
+// parse a ClientHello from the first bytes sent by a client
+func parseClientHello(data []byte) (*ClientHello, error) {
+	msg, _ := handshakeMessage(data)
+	s := cryptobyte.String(msg)
+	var msgType uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != 1 || !s.ReadUint24LengthPrefixed(&body) {
+		return nil, fmt.Errorf("not a ClientHello")
+	}
+
+	var legacyVersion uint16
+	var random, sessionId []byte
+	var ciphers, compressions, extensions cryptobyte.String
+	if !body.ReadUint16(&legacyVersion) || !body.ReadBytes(&random, 32) ||
+		!body.ReadUint8LengthPrefixed((*cryptobyte.String)(&sessionId)) ||
+		!body.ReadUint16LengthPrefixed(&ciphers) ||
+		!body.ReadUint8LengthPrefixed(&compressions) {
+		return nil, fmt.Errorf("malformed ClientHello")
+	}
+	if !body.Empty() && !body.ReadUint16LengthPrefixed(&extensions) {
+		return nil, fmt.Errorf("malformed ClientHello extensions")
+	}
+
+	h := &ClientHello{}
+	var cipherList, extList, groups, points, sigAlgs, versions []uint16
+	for !ciphers.Empty() {
+		var c uint16
+		if !ciphers.ReadUint16(&c) {
+			return nil, fmt.Errorf("malformed cipher suites")
+		}
+		if !isGREASE(c) {
+			cipherList = append(cipherList, c)
+			h.CipherSuites = append(h.CipherSuites, tls.CipherSuiteName(c))
+		}
+	}
+	readList := func(s cryptobyte.String) (l []uint16) {
+		var v uint16
+		for s.ReadUint16(&v) {
+			if !isGREASE(v) {
+				l = append(l, v)
+			}
+		}
+		return
+	}
+	for !extensions.Empty() {
+		var typ uint16
+		var ext cryptobyte.String
+		if !extensions.ReadUint16(&typ) || !extensions.ReadUint16LengthPrefixed(&ext) {
+			return nil, fmt.Errorf("malformed extension")
+		}
+		if isGREASE(typ) {
+			continue
+		}
+		extList = append(extList, typ)
+
+		var list cryptobyte.String
+		switch typ {
+		case extServerName:
+			var nameType uint8
+			var name cryptobyte.String
+			if ext.ReadUint16LengthPrefixed(&list) && list.ReadUint8(&nameType) && nameType == 0 && list.ReadUint16LengthPrefixed(&name) {
+				h.ServerName = string(name)
+			}
+		case extSupportedGroups:
+			if ext.ReadUint16LengthPrefixed(&list) {
+				groups = readList(list)
+			}
+		case extECPointFormats:
+			var formats []byte
+			if ext.ReadUint8LengthPrefixed((*cryptobyte.String)(&formats)) {
+				for _, f := range formats {
+					points = append(points, uint16(f))
+				}
+			}
+		case extSignatureAlgorithms:
+			if ext.ReadUint16LengthPrefixed(&list) {
+				sigAlgs = readList(list)
+			}
+		case extALPN:
+			if ext.ReadUint16LengthPrefixed(&list) {
+				var proto cryptobyte.String
+				for list.ReadUint8LengthPrefixed(&proto) {
+					h.ALPN = append(h.ALPN, string(proto))
+				}
+			}
+		case extSupportedVersions:
+			if ext.ReadUint8LengthPrefixed(&list) {
+				versions = readList(list)
+			}
+		}
+	}
+	if len(versions) == 0 {
+		versions = []uint16{legacyVersion}
+	}
+	for _, v := range versions {
+		h.Versions = append(h.Versions, tls.VersionName(v))
+	}
+
+	// JA3: version,ciphers,extensions,groups,point formats
+	h.JA3 = strings.Join([]string{
+		strconv.Itoa(int(legacyVersion)),
+		joinValues(cipherList, "%d", "-"),
+		joinValues(extList, "%d", "-"),
+		joinValues(groups, "%d", "-"),
+		joinValues(points, "%d", "-"),
+	}, ",")
+	sum := md5.Sum([]byte(h.JA3))
+	h.JA3Hash = hex.EncodeToString(sum[:])
+
+	h.JA4 = ja4(h, versions, cipherList, extList, sigAlgs)
+	return h, nil
+}
+
+// JA4 fingerprint of a ClientHello over TCP
+func ja4(h *ClientHello, versions, ciphers, extensions, sigAlgs []uint16) string {
+	var max uint16
+	for _, v := range versions {
+		if v > max {
+			max = v
+		}
+	}
+	version := map[uint16]string{0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3"}[max]
+	if version == "" {
+		version = "00"
+	}
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+	count := func(n int) string {
+		if n > 99 {
+			n = 99
+		}
+		return fmt.Sprintf("%02d", n)
+	}
+	alpn := "00"
+	if len(h.ALPN) > 0 && h.ALPN[0] != "" {
+		p := h.ALPN[0]
+		first, last := p[0], p[len(p)-1]
+		if isAlnum(first) && isAlnum(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			alpn = hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+		}
+	}
+
+	hash := func(s string) string {
+		if s == "" {
+			return "000000000000"
+		}
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])[:12]
+	}
+	sorted := func(l []uint16) []uint16 {
+		l = append([]uint16(nil), l...)
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		return l
+	}
+	var exts []uint16
+	for _, e := range extensions {
+		if e != extServerName && e != extALPN {
+			exts = append(exts, e)
+		}
+	}
+	extPart := joinValues(sorted(exts), "%04x", ",")
+	if len(sigAlgs) > 0 && extPart != "" {
+		extPart += "_" + joinValues(sigAlgs, "%04x", ",")
+	}
+
+	return "t" + version + sni + count(len(ciphers)) + count(len(extensions)) + alpn +
+		"_" + hash(joinValues(sorted(ciphers), "%04x", ",")) +
+		"_" + hash(extPart)
+}
+
+func joinValues(l []uint16, format, sep string) string {
+	s := make([]string, len(l))
+	for i, v := range l {
+		s[i] = fmt.Sprintf(format, v)
+	}
+	return strings.Join(s, sep)
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// max bytes recorded to find the ClientHello
+const helloRecordMax = 64 * 1024
+
+// a connection that records the first bytes from a client, to parse its ClientHello
+type helloConn struct {
+	net.Conn
+
+	mutex sync.Mutex
+	buf   []byte
+	done  bool
+	hello *ClientHello
+}
+
+func (c *helloConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	if n > 0 {
+		c.mutex.Lock()
+		if !c.done {
+			c.buf = append(c.buf, p[:n]...)
+			// stop recording once the ClientHello is read
+			if _, complete := handshakeMessage(c.buf); complete || len(c.buf) >= helloRecordMax {
+				c.parse()
+			}
+		}
+		c.mutex.Unlock()
+	}
+	return
+}
+
+// parse the recorded ClientHello and release the buffer. must be called with the mutex locked.
+func (c *helloConn) parse() {
+	c.done = true
+	c.hello, _ = parseClientHello(c.buf)
+	c.buf = nil
+}
+
+// the ClientHello. must be called after the handshake. nil if not parsed.
+func (c *helloConn) clientHello() *ClientHello {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.done {
+		c.parse()
+	}
+	return c.hello
+}
@@ -0,0 +1,82 @@
+package httpscapture
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		c := tls.Client(client, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+		c.Handshake()
+		client.Close()
+	}()
+
+	var data []byte
+	buf := make([]byte, 4096)
+	var h *ClientHello
+	for h == nil {
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, buf[:n]...)
+		h, _ = parseClientHello(data)
+	}
+
+	if h.ServerName != "example.com" || len(h.ALPN) != 2 || h.ALPN[0] != "h2" {
+		t.Errorf("invalid ClientHello: %+v", h)
+	}
+	if h.Versions[0] != "TLS 1.3" {
+		t.Errorf("invalid versions: %v", h.Versions)
+	}
+	if !strings.HasPrefix(h.JA3, "771,") || len(h.JA3Hash) != 32 {
+		t.Errorf("invalid JA3: %s %s", h.JA3, h.JA3Hash)
+	}
+	if !strings.HasPrefix(h.JA4, "t13d") || !strings.Contains(h.JA4, "h2_") || len(h.JA4) != 36 {
+		t.Errorf("invalid JA4: %s", h.JA4)
+	}
+
+	if _, err := parseClientHello([]byte("GET / HTTP/1.1\r\n")); err == nil {
+		t.Errorf("not a ClientHello parsed")
+	}
+}
+
+func TestHelloConn(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		c := tls.Client(client, &tls.Config{ServerName: "example.com"})
+		c.Handshake()
+		client.Close()
+	}()
+
+	// the recording stops once the ClientHello is read
+	c := &helloConn{Conn: server}
+	buf := make([]byte, 100)
+	for !c.done {
+		if _, err := c.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.Close()
+	if c.buf != nil || c.hello == nil || c.clientHello().ServerName != "example.com" {
+		t.Errorf("invalid ClientHello: %v", c.hello)
+	}
+}
+
+func TestGREASE(t *testing.T) {
+	for _, v := range []uint16{0x0a0a, 0x1a1a, 0xfafa} {
+		if !isGREASE(v) {
+			t.Errorf("%04x is GREASE", v)
+		}
+	}
+	for _, v := range []uint16{0x0a1a, 0x1301, 0x0000} {
+		if isGREASE(v) {
+			t.Errorf("%04x is not GREASE", v)
+		}
+	}
+}
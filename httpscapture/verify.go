@@ -0,0 +1,186 @@
+package httpscapture
+
+//
+// Verification of the upstream server certificates
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Verification policies of the server certificates
+const (
+	VerifyInsecure = "insecure" // not verified
+	VerifyWarn     = "warn"     // recorded in the session, and the client is given a cert from an untrusted CA
+	VerifyStrict   = "strict"   // the request fails
+)
+
+const (
+	probeTimeout = 10 * time.Second
+	probeTTL     = 10 * time.Minute // handshake results of the servers are cached for this duration
+	probeFailTTL = 30 * time.Second // failed handshakes are cached for this duration
+)
+
+// a cached handshake result of a server
+type probeResult struct {
+	leaf    *x509.Certificate // the server cert; nil if the server is not reachable
+	invalid bool              // the server cert is not valid
+	expires time.Time
+}
+
+// verify the certificate chain of a server for the host
+func (p *Proxy) verifyUpstream(state *tls.ConnectionState, host string) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("no server certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         p.opt.UpstreamRoots,
+		DNSName:       host,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// the cert of the server at addr for serverName, by a handshake to the server. The results are cached.
+func (p *Proxy) probeUpstream(addr, serverName string) *probeResult {
+	if serverName == "" {
+		serverName = hostName(addr)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+	key := addr + " " + serverName
+	p.probeMutex.Lock()
+	r := p.probes[key]
+	p.probeMutex.Unlock()
+	if r != nil && time.Now().Before(r.expires) {
+		return r
+	}
+
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: true}
+	if len(p.opt.ClientCerts) > 0 {
+		config.GetClientCertificate = p.clientCertificate
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), upstreamHostKey{}, serverName), probeTimeout)
+	defer cancel()
+	r = &probeResult{expires: time.Now().Add(probeFailTTL)}
+	conn, err := p.dialUpstream(ctx, addr)
+	if err == nil {
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.HandshakeContext(ctx)
+		if err == nil {
+			state := tlsConn.ConnectionState()
+			r = &probeResult{
+				leaf:    state.PeerCertificates[0],
+				invalid: p.verifyUpstream(&state, serverName) != nil,
+				expires: time.Now().Add(probeTTL),
+			}
+		}
+		conn.Close()
+	}
+	p.probeMutex.Lock()
+	p.probes[key] = r
+	p.probeMutex.Unlock()
+	return r
+}
+
+// dial a server in the same way as the requests to the servers; through the upstream proxy of the transport, if any
+func (p *Proxy) dialUpstream(ctx context.Context, addr string) (net.Conn, error) {
+	tr := p.proxy.Tr
+	if tr.Proxy != nil {
+		proxyURL, err := tr.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL != nil {
+			dial := p.proxy.NewConnectDialToProxy(proxyURL.String())
+			if dial == nil {
+				return nil, fmt.Errorf("unsupported upstream proxy: %s", proxyURL.Redacted())
+			}
+			// the dialer has no context
+			type result struct {
+				conn net.Conn
+				err  error
+			}
+			ch := make(chan result, 1)
+			go func() {
+				c, e := dial("tcp", addr)
+				ch <- result{c, e}
+			}()
+			select {
+			case r := <-ch:
+				return r.conn, r.err
+			case <-ctx.Done():
+				go func() {
+					if r := <-ch; r.conn != nil {
+						r.conn.Close()
+					}
+				}()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	if tr.DialContext != nil {
+		return tr.DialContext(ctx, "tcp", addr)
+	}
+	return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+}
+
+// test whether the server at addr presents an invalid certificate for serverName.
+// A server not reachable is not considered invalid; the requests will fail by themselves.
+func (p *Proxy) upstreamInvalid(addr, serverName string) bool {
+	return p.probeUpstream(addr, serverName).invalid
+}
+
+// the cert of the server at addr for serverName. nil if the server is not reachable.
+func (p *Proxy) upstreamCert(addr, serverName string) *x509.Certificate {
+	return p.probeUpstream(addr, serverName).leaf
+}
+
+// a throwaway CA, never to be trusted by the clients
+func newUntrustedCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "https_capture untrusted CA (the server certificate is not valid)"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
@@ -0,0 +1,166 @@
+package httpscapture
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamVerify(t *testing.T) {
+	// a server with a self-signed cert
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(backend.Certificate())
+
+	get := func(t *testing.T, opt Options, insecureClient bool) (*http.Response, *SessionRecord, error) {
+		sink := &testSink{closed: make(chan *SessionRecord, 4)}
+		opt.Sinks = []Sink{sink}
+		p := newTestProxy(t, opt)
+		err := p.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+
+		resp, err := proxyClient(p, insecureClient).Get(backend.URL)
+		if err != nil {
+			return nil, nil, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		select {
+		case rec := <-sink.closed:
+			return resp, rec, nil
+		case <-time.After(5 * time.Second):
+			t.Fatalf("session not closed")
+		}
+		return nil, nil, nil
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		resp, rec, err := get(t, Options{UpstreamVerify: VerifyStrict}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadGateway || rec.State != StateFailed {
+			t.Errorf("invalid server cert accepted: %d %s", resp.StatusCode, rec.State)
+		}
+	})
+
+	t.Run("strict with roots", func(t *testing.T) {
+		resp, rec, err := get(t, Options{UpstreamVerify: VerifyStrict, UpstreamRoots: roots}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || rec.UpstreamTLS.VerifyError != "" {
+			t.Errorf("valid server cert rejected: %d %s", resp.StatusCode, rec.UpstreamTLS.VerifyError)
+		}
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		// the client does not trust the cert
+		_, _, err := get(t, Options{UpstreamVerify: VerifyWarn}, false)
+		if err == nil {
+			t.Errorf("invalid server cert not passed to the client")
+		}
+
+		// and the error is recorded
+		resp, rec, err := get(t, Options{UpstreamVerify: VerifyWarn}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || rec.UpstreamTLS == nil || rec.UpstreamTLS.VerifyError == "" {
+			t.Errorf("verification error not recorded")
+		}
+	})
+
+	t.Run("warn with roots", func(t *testing.T) {
+		_, rec, err := get(t, Options{UpstreamVerify: VerifyWarn, UpstreamRoots: roots}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.UpstreamTLS.VerifyError != "" {
+			t.Errorf("valid server cert rejected: %s", rec.UpstreamTLS.VerifyError)
+		}
+	})
+
+	if _, err := New(Options{CACert: &x509.Certificate{}, CAKey: "key", UpstreamVerify: "maybe"}); err == nil {
+		t.Errorf("unknown policy accepted")
+	}
+}
+
+func TestProbeUpstream(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	addr := backend.Listener.Addr().String()
+
+	t.Run("failure cached", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed := l.Addr().String()
+		l.Close()
+
+		p := newTestProxy(t, Options{})
+		r := p.probeUpstream(closed, "example.com")
+		if r.leaf != nil {
+			t.Fatalf("unreachable server probed")
+		}
+		cached := p.probes[closed+" example.com"]
+		if cached != r {
+			t.Fatalf("failed probe not cached")
+		}
+		if r.expires.After(time.Now().Add(probeFailTTL)) {
+			t.Errorf("failed probe cached for too long: %v", time.Until(r.expires))
+		}
+	})
+
+	t.Run("upstream proxy", func(t *testing.T) {
+		// a CONNECT proxy counting the tunnels
+		var tunnels int32
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodConnect {
+				http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+				return
+			}
+			atomic.AddInt32(&tunnels, 1)
+			dst, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			defer dst.Close()
+			src, _, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				return
+			}
+			defer src.Close()
+			io.WriteString(src, "HTTP/1.1 200 OK\r\n\r\n")
+			go io.Copy(dst, src)
+			io.Copy(src, dst)
+		}))
+		defer upstream.Close()
+		proxyURL, _ := url.Parse(upstream.URL)
+
+		p := newTestProxy(t, Options{})
+		p.proxy.Tr.Proxy = http.ProxyURL(proxyURL)
+		r := p.probeUpstream(addr, "example.com")
+		if r.leaf == nil || !r.leaf.Equal(backend.Certificate()) {
+			t.Fatalf("server not probed through the upstream proxy")
+		}
+		if atomic.LoadInt32(&tunnels) != 1 {
+			t.Errorf("upstream proxy not used: %d tunnels", tunnels)
+		}
+	})
+}
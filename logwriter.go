@@ -1,61 +1,147 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
+// A log file that can be rotated while writing
+type logFile struct {
+	mutex sync.Mutex
+	name  string
+	f     *os.File
+}
+
+// the log files of the routes, open until closed
 var (
-	logWriter   io.Writer
-	chLogBuffer = make(chan []byte, 64)
+	routeLogsMutex sync.Mutex
+	routeLogs      []*logFile
 )
 
-type hlog struct {
-	b *bytes.Buffer
+// create a log file
+func openLogFile(filename string) (l *logFile, err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	return &logFile{name: filename, f: f}, nil
 }
 
-func newLog() *hlog {
-	return &hlog{b: &bytes.Buffer{}}
+// create a log file of a route, rotated along with the main log
+func openRouteLogFile(filename string) (l *logFile, err error) {
+	l, err = openLogFile(filename)
+	if err != nil {
+		return
+	}
+	routeLogsMutex.Lock()
+	routeLogs = append(routeLogs, l)
+	routeLogsMutex.Unlock()
+	return
 }
 
-func (l *hlog) Write(p []byte) (n int, err error) {
-	return l.b.Write(p)
+// rotate the open logs of the routes
+func rotateRouteLogs() (rotated []string, err error) {
+	routeLogsMutex.Lock()
+	defer routeLogsMutex.Unlock()
+	for _, l := range routeLogs {
+		name, e := l.Rotate()
+		if e == os.ErrClosed {
+			continue
+		}
+		if e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		rotated = append(rotated, name)
+	}
+	return
 }
 
-func (l *hlog) writef(format string, arg ...interface{}) {
-	fmt.Fprintf(l.b, format, arg...)
+func (l *logFile) Write(p []byte) (n int, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.f == nil {
+		return 0, os.ErrClosed
+	}
+	return l.f.Write(p)
 }
 
-func (l *hlog) flush() {
-	buf := l.b.Bytes()
-	if len(buf) > 0 {
-		go func() {
-			chLogBuffer <- buf
-		}()
+func (l *logFile) Close() (err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.f != nil {
+		err = l.f.Close()
+		l.f = nil
 	}
+	return
 }
 
-func startLog() {
-	go func() {
-		ok := true
-		for buf := range chLogBuffer {
-			if !ok {
-				continue
-			}
-			_, err := logWriter.Write(buf)
-			if err != nil {
-				ok = false
-				chError <- err
-			}
-			if tee {
-				os.Stdout.Write(buf)
-			}
-		}
-	}()
+// rename the current log file with a timestamp and start a new one
+func (l *logFile) Rotate() (rotatedName string, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.f == nil {
+		return "", os.ErrClosed
+	}
+	ext := ""
+	if i := strings.LastIndex(l.name, "."); i > strings.LastIndexAny(l.name, `/\`) {
+		ext = l.name[i:]
+	}
+	rotatedName = strings.TrimSuffix(l.name, ext) + "." + time.Now().Format("20060102-150405") + ext
+
+	// the file is closed before renaming, as an open file cannot be renamed on some systems.
+	// On failure, the log is continued on the current file.
+	err = l.f.Close()
+	if err == nil {
+		err = os.Rename(l.name, rotatedName)
+	}
+	if err != nil {
+		l.reopen(l.name)
+		return "", err
+	}
+	f, err := os.Create(l.name)
+	if err != nil {
+		l.reopen(rotatedName)
+		return "", err
+	}
+	l.f = f
+	return
 }
 
-func stopLog() {
-	close(chLogBuffer)
+// continue the log on an existing file
+func (l *logFile) reopen(filename string) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		l.f = nil
+		return
+	}
+	l.f = f
 }
+
+// write a line to the log
+func logf(format string, arg ...interface{}) {
+	if logOutput != nil {
+		fmt.Fprintf(logOutput, format, arg...)
+	}
+}
+
+// create an output file. "-" for stdout.
+func createOutput(filename string) (io.WriteCloser, error) {
+	if filename == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.Create(filename)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -9,12 +9,13 @@ package main
 import (
 	"bufio"
 	"context"
-	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -24,17 +25,16 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
-	//"github.com/elazarl/goproxy"
-	"github.com/mixcode/goproxy" // a clone of elazarl/goproxy with fixes for TLS SNI
+	"github.com/mixcode/https_capture/httpscapture"
+	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
 const (
-	defaultListenAddr  = ":38080"
+	defaultListenAddr  = httpscapture.DefaultListenAddr
 	defaultCaptureDir  = "./captured"
 	defaultLogFileName = "log.txt"
-
-	filenameMaxLen = 32
 )
 
 var (
@@ -43,22 +43,71 @@ var (
 	listenAddress  string = defaultListenAddr
 	useBuiltinCert        = false
 
+	usersFile    = "" // users of the proxy, in user:password lines
+	allowClients = "" // comma-separated IP ranges of the clients allowed
+	denyClients  = "" // comma-separated IP ranges of the clients denied
+
+	tagHeader = ""                            // a request header tagging the sessions, e.g. X-Capture-Tag
+	routeBy   = ""                            // route the sessions not matching the rules by ip, user or tag
+	maxRoutes = httpscapture.DefaultMaxRoutes // max number of routes made by routeBy
+
+	routes []*httpscapture.Route // rules routing the sessions to subdirectories
+
+	redact        = false                   // redact secrets before the sessions are written
+	redactMode    = httpscapture.RedactMask // mask or hash
+	redactKey     = ""                      // key of the hash. random if empty
+	redactHeaders = ""                      // comma-separated headers to be redacted
+	redactParams  = ""                      // comma-separated params and JSON keys to be redacted
+
+	redactPatterns  []*regexp.Regexp // patterns in the bodies to be redacted
+	redactJSONPaths []string         // JSON paths to be redacted
+
 	captureDir  string = defaultCaptureDir
 	logFileName string = filepath.Join(captureDir, defaultLogFileName)
 
 	rawPostForm      = false // print x-www-form-urlencoded in raw querystring
 	logPostInline    = false
 	logPostInlineAll = false
-	//rawCompressedBody	= false	// if true, body is stored in its raw (maybe compressed) form
+
+	rawCompressedBody = false // if true, body is also stored in its raw (maybe compressed) form
+	saveUTF8          = false // if true, text bodies in other charsets are also stored in UTF-8
+	prettyPrint       = false // if true, JSON, XML and form bodies are pretty-printed
+
+	grpcDescriptorFile = "" // a FileDescriptorSet to decode gRPC messages
+
+	upstreamVerify = httpscapture.VerifyInsecure // verification policy of the server certs
+	upstreamCAFile = ""                          // additional trusted roots of the servers, in PEM
+
+	certPage = true // serve the CA cert to the proxied clients at http://https-capture.cert/
+
+	leafKey        = ""            // key type of the MITM certs
+	leafValidity   = 0 * time.Hour // validity of the MITM certs; the default of httpscapture if 0
+	mirrorUpstream = false         // copy the subject, SANs and validity of the server certs
+
+	permittedDNS       = ""                            // name constraints of a generated CA; comma-separated domains
+	permittedIP        = ""                            // and IP ranges
+	outsideConstraints = httpscapture.ConstraintTunnel // handling of the hosts outside the name constraints of the CA
+
+	clientCertSpecs   []string // client certs to the servers, in PATTERN=CERT[,KEY]
+	clientCertPass    = ""     // password of PKCS#12 client certs
+	requestClientCert = false  // ask the clients for a cert
+
 	cleanCaptureDir = false
 	tee             = false
 	verbose         = false
 
+	jsonlFileName = "" // write sessions in JSON Lines to this file, if set
+	jsonlBodies   = false
+	harFileName   = "" // write sessions in HAR to this file on exit, if set
+
 	force = false
 
 	// non-TLS servers for connect
-	nonTLSPort = make(map[int]bool)
-	//nonTLSAddr = make(map[string]bool)
+	nonTLSPorts []int
+
+	// save filters
+	saveContentTypes []string
+	saveIfMatch      []*regexp.Regexp
 
 	// cert and key filename (supplied by argument 0 and 1)
 	certFile = ""
@@ -66,13 +115,18 @@ var (
 
 	// cert/key
 	rootCert   *x509.Certificate
+	caChain    []*x509.Certificate // chain of an intermediate CA, up to the root
 	privateKey interface{}
 
 	// error handling
 	chError = make(chan error, 1)
 
-	// host:port matcher
-	mMatchHost = regexp.MustCompile(`^(.*):(\d+)$`)
+	// the running proxy
+	proxy *httpscapture.Proxy
+
+	// the log output, and the log file if the log is written to a file
+	logOutput io.Writer
+	logFileW  *logFile
 )
 
 // ==============================
@@ -95,52 +149,23 @@ func runProxy() (err error) {
 		if certFile == "" {
 			return fmt.Errorf("no certfiticate file supplied. A Root CA cert in PEM format must be given.\n(If you don't have a cert, '%[1]s -generate-cert' will give you a dummy insecure self-signed cert. Be sure to install the cert to your web client and try again. See '%[1]s -help' for all options)", os.Args[0])
 		}
-		var pm, rest []byte
-		var pb *pem.Block
-		pm, err = os.ReadFile(certFile)
+		var key interface{}
+		rootCert, caChain, key, err = loadRootCA(certFile, keyFile)
 		if err != nil {
 			return
 		}
-		pb, rest = pem.Decode(pm)
-		if pb == nil {
-			return fmt.Errorf("cert file contains no PEM block")
-		}
-		rootCert, err = x509.ParseCertificate(pb.Bytes)
-		if err != nil {
-			return
+		if key != nil {
+			privateKey = key
 		}
 		if verbose {
 			fmt.Printf("Root CA cert read from '%s'\n", certFile)
-		}
-
-		if keyFile != "" {
-			// open keyfile
-			pm, err = os.ReadFile(keyFile)
-			if err != nil {
-				return
-			}
-			pb, _ = pem.Decode(pm)
-			if pb == nil {
-				return fmt.Errorf("key file contains no PEM block")
-			}
-			privateKey, err = x509.ParsePKCS8PrivateKey(pb.Bytes)
-			if err != nil {
-				return
+			if len(caChain) > 0 {
+				fmt.Printf("The CA is an intermediate CA of '%s'\n", caChain[len(caChain)-1].Subject)
 			}
-			if verbose {
+			if keyFile != "" {
 				fmt.Printf("Private key read from '%s'\n", keyFile)
-			}
-		} else {
-			// check whether there is an additional key at the end of the cert
-			pb, _ = pem.Decode(rest)
-			if pb != nil {
-				privateKey, err = x509.ParsePKCS8PrivateKey(pb.Bytes)
-				if err != nil {
-					return
-				}
-				if verbose {
-					fmt.Printf("A Private key is also read from the cert file\n")
-				}
+			} else if key != nil {
+				fmt.Printf("A Private key is also read from the cert file\n")
 			}
 		}
 	}
@@ -156,111 +181,242 @@ func runProxy() (err error) {
 
 	// prepare the logfile
 	if logFileName == "-" {
-		logWriter = os.Stdout
+		logOutput = os.Stdout
 	} else {
-		w, e := os.Create(logFileName)
-		if e != nil {
-			err = e
+		logFileW, err = openLogFile(logFileName)
+		if err != nil {
 			return
 		}
 		defer func() {
-			e := w.Close()
+			e := logFileW.Close()
 			if err == nil {
 				err = e
 			}
 		}()
-		logWriter = w
+		logOutput = logFileW
+	}
+	if tee {
+		logOutput = io.MultiWriter(logOutput, os.Stdout)
 	}
-	startLog()
-	defer stopLog()
 
-	// build a TLS cert
-	if rootCert == nil {
-		err = fmt.Errorf("root cert is nil")
-		return
+	// prepare the sinks
+	sinks := []httpscapture.Sink{
+		&httpscapture.FileSink{Dir: captureDir, RawPostForm: rawPostForm},
+		&httpscapture.TextSink{W: logOutput, RawPostForm: rawPostForm},
+	}
+	if len(routes) > 0 || routeBy != "" {
+		// the routed sessions go to the subdirectories
+		sinks = []httpscapture.Sink{newRouteSink(sinks)}
+	}
+	if jsonlFileName != "" {
+		var w io.WriteCloser
+		w, err = createOutput(jsonlFileName)
+		if err != nil {
+			return
+		}
+		defer w.Close()
+		sinks = append(sinks, &httpscapture.JSONLSink{W: w, Bodies: jsonlBodies})
+	}
+	if harFileName != "" {
+		var w io.WriteCloser
+		w, err = createOutput(harFileName)
+		if err != nil {
+			return
+		}
+		defer w.Close() // closed after the HAR sink is written by proxy.Close()
+		sinks = append(sinks, &httpscapture.HARSink{W: w})
 	}
-	var cert tls.Certificate
-	cert.Certificate = append(cert.Certificate, rootCert.Raw)
-	cert.PrivateKey = privateKey
 
-	// prepare the proxy engine
-	proxy := goproxy.NewProxyHttpServer()
-
-	tlsConnectAction := &goproxy.ConnectAction{ // new connection handler
-		Action:    goproxy.ConnectMitm,
-		TLSConfig: goproxy.TLSConfigFromCA(&cert),
-	}
-	rawConnectAction := &goproxy.ConnectAction{
-		Action:    goproxy.ConnectHTTPMitm,
-		TLSConfig: goproxy.TLSConfigFromCA(&cert),
-	}
-	var connectHandler goproxy.FuncHttpsHandler = func(host string, proxyCtx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-		m := mMatchHost.FindStringSubmatch(host)
-		if m != nil {
-			// see the port number and test for non-TLS ports
-			port, e := strconv.Atoi(m[2])
-			if e == nil && nonTLSPort[port] {
-				fmt.Printf("RAW CONNECT: host[%s], %v\n", host, proxyCtx.Req)
-				return rawConnectAction, host
-			}
+	// load gRPC descriptors
+	var protoFiles *protoregistry.Files
+	if grpcDescriptorFile != "" {
+		protoFiles, err = httpscapture.LoadDescriptorSet(grpcDescriptorFile)
+		if err != nil {
+			return
 		}
-		fmt.Printf("TLS CONNECT: host[%s], %v\n", host, proxyCtx.Req)
+	}
 
-		return tlsConnectAction, host
+	// load trusted roots of the servers
+	var upstreamRoots *x509.CertPool
+	if upstreamCAFile != "" {
+		upstreamRoots, err = loadCertPool(upstreamCAFile)
+		if err != nil {
+			return
+		}
 	}
-	proxy.OnRequest().HandleConnect(connectHandler)
 
-	proxy.OnRequest().DoFunc(reqHandler)   // http request handler
-	proxy.OnResponse().DoFunc(respHandler) // http response handler
+	// load the access control of the proxy
+	var users httpscapture.Users
+	if usersFile != "" {
+		users, err = httpscapture.LoadUsers(usersFile)
+		if err != nil {
+			return
+		}
+	}
+	allowed, err := parseIPRanges(allowClients)
+	if err != nil {
+		return
+	}
+	denied, err := parseIPRanges(denyClients)
+	if err != nil {
+		return
+	}
+	if users == nil && allowed == nil {
+		if h, _, e := net.SplitHostPort(listenAddress); e == nil && !isLoopback(h) {
+			fmt.Fprintf(os.Stderr, "warning: the proxy on %s is open to anyone on the network. Consider -users or -allow-clients\n", listenAddress)
+		}
+	}
 
-	if verbose {
-		proxy.Verbose = goproxy.LOGLEVEL_VERBOSE
-	} else {
-		proxy.Verbose = goproxy.LOGLEVEL_NONE
+	// load client certs to the servers
+	var clientCerts []*httpscapture.ClientCert
+	for _, spec := range clientCertSpecs {
+		var c *httpscapture.ClientCert
+		c, err = loadClientCert(spec)
+		if err != nil {
+			return
+		}
+		clientCerts = append(clientCerts, c)
+	}
+
+	// prepare the proxy engine
+	opt := httpscapture.Options{
+		Addr:               listenAddress,
+		Users:              users,
+		AllowClients:       allowed,
+		DenyClients:        denied,
+		TagHeader:          tagHeader,
+		Routes:             routes,
+		RouteBy:            routeBy,
+		MaxRoutes:          maxRoutes,
+		CACert:             rootCert,
+		CAKey:              privateKey,
+		CAChain:            caChain,
+		Sinks:              sinks,
+		CaptureDir:         captureDir,
+		LogPostInline:      logPostInline,
+		LogPostInlineAll:   logPostInlineAll,
+		RawBody:            rawCompressedBody,
+		SaveUTF8:           saveUTF8,
+		Pretty:             prettyPrint,
+		ProtoFiles:         protoFiles,
+		NonTLSPorts:        nonTLSPorts,
+		UpstreamVerify:     upstreamVerify,
+		UpstreamRoots:      upstreamRoots,
+		ClientCerts:        clientCerts,
+		RequestClientCert:  requestClientCert,
+		OutsideConstraints: outsideConstraints,
+		CertPage:           certPage,
+		LeafKey:            leafKey,
+		LeafValidity:       leafValidity,
+		MirrorUpstream:     mirrorUpstream,
+		SaveContentTypes:   saveContentTypes,
+		SaveIfMatch:        saveIfMatch,
+		HistoryMax:         historyMax,
+		Redact:             redaction(),
+		Verbose:            verbose,
+	}
+	if !useTUI {
+		opt.Output = os.Stdout
+	}
+	proxy, err = httpscapture.New(opt)
+	if err != nil {
+		return
 	}
 
 	// start the proxy engine
 	var wg sync.WaitGroup
-	server := &http.Server{Addr: listenAddress, Handler: proxy}
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		e := server.ListenAndServe()
-		if e == http.ErrServerClosed {
-			e = nil
-		}
-		chError <- e // send a nil error
-	}()
+	err = proxy.Start(context.Background())
+	if err != nil {
+		return
+	}
 	if verbose {
 		fmt.Println("proxy started")
 	}
 
+	// start the web UI and the control API
+	var auxServers []*http.Server
+	if uiListenAddress != "" {
+		auxServers = append(auxServers, startAuxServer(&wg, uiListenAddress, newWebUIHandler()))
+		if verbose {
+			fmt.Printf("web UI started on %s\n", uiListenAddress)
+		}
+	}
+	if apiListenAddress != "" {
+		auxServers = append(auxServers, startAuxServer(&wg, apiListenAddress, newAPIHandler()))
+		if verbose {
+			fmt.Printf("control API started on %s\n", apiListenAddress)
+		}
+	}
+
+	// start the terminal UI
+	tuiStop, tuiDone := make(chan struct{}), make(chan struct{})
+	if useTUI {
+		go func() {
+			defer close(tuiDone)
+			e := runTUI(tuiStop)
+			if e != nil {
+				stopProxy(e)
+			}
+		}()
+	} else {
+		close(tuiDone)
+	}
+
 	// wait for an OS signal
 	chSignal := make(chan os.Signal, 1)
 	signal.Notify(chSignal, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	select {
-	case s := <-chSignal: // a signal received
-		if verbose {
-			fmt.Printf("received an OS signal (%v)\n", s)
-		}
+loop:
+	for {
+		select {
+		case s := <-chSignal: // a signal received
+			if verbose {
+				fmt.Printf("received an OS signal (%v)\n", s)
+			}
+			break loop
 
-	case err = <-chError: // some error
-		if err != nil {
+		case err = <-chError: // some error
+			if err != nil {
+				if verbose {
+					fmt.Printf("an error detected: %v\n", err)
+				}
+			}
+			break loop
+
+		case err = <-proxy.Errors(): // an error from the proxy
+			var sinkErr *httpscapture.SinkError
+			if errors.As(err, &sinkErr) {
+				// a failing sink does not stop the proxy
+				if !useTUI {
+					fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+				}
+				err = nil
+				continue
+			}
 			if verbose {
 				fmt.Printf("an error detected: %v\n", err)
 			}
+			break loop
 		}
 	}
 
+	// restore the terminal
+	close(tuiStop)
+	<-tuiDone
+
 	// terminate the proxy
 	if verbose {
 		fmt.Println("terminating proxy...")
 	}
-	if e := server.Shutdown(context.TODO()); err == nil {
+	if e := proxy.Close(); err == nil {
 		err = e
 	}
+	for _, srv := range auxServers {
+		// SSE streams never end by themselves; close them forcibly
+		if e := srv.Close(); err == nil {
+			err = e
+		}
+	}
 	wg.Wait()
 	if verbose {
 		fmt.Println("proxy terminated")
@@ -294,7 +450,11 @@ func genCert() (err error) {
 		}()
 		w = fo
 	}
-	ca, err := genRootCA(defaultKey)
+	nc, err := parseNameConstraints(permittedDNS, permittedIP)
+	if err != nil {
+		return
+	}
+	ca, err := genCA(defaultKey, nil, nil, "https_capture dummy Root CA", 10*365*24*time.Hour, nc)
 	if err != nil {
 		return
 	}
@@ -348,13 +508,36 @@ func printCert() (err error) {
 // utilities
 //==================================
 
+// stop the running proxy with an error, or nil to quit normally.
+// Only the first one is taken; the others are dropped while the proxy is stopping.
+func stopProxy(err error) {
+	select {
+	case chError <- err:
+	default:
+	}
+}
+
+// start a HTTP server for the UI or the API
+func startAuxServer(wg *sync.WaitGroup, addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		e := srv.ListenAndServe()
+		if e != nil && e != http.ErrServerClosed {
+			stopProxy(e)
+		}
+	}()
+	return srv
+}
+
 // check for file existency and prompt for overwriting it
 func promptOverwriteFile(filename string) bool {
 	if force {
 		// overwrite it no matther of what
 		return true
 	}
-	_, e := os.Stat(certFile)
+	_, e := os.Stat(filename)
 	if os.IsNotExist(e) {
 		return true
 	}
@@ -393,6 +576,41 @@ func emptyDir(path string) (err error) {
 	return
 }
 
+// test whether a listening host is of the loopback interface
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// the redaction rules of the flags. nil if not redacted.
+func redaction() *httpscapture.Redaction {
+	split := func(list string) (a []string) {
+		for _, s := range strings.Split(list, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				a = append(a, s)
+			}
+		}
+		return
+	}
+	rd := &httpscapture.Redaction{
+		Mode:      redactMode,
+		Headers:   split(redactHeaders),
+		Params:    split(redactParams),
+		Patterns:  redactPatterns,
+		JSONPaths: redactJSONPaths,
+	}
+	if redactKey != "" {
+		rd.Key = []byte(redactKey)
+	}
+	if !redact && rd.Headers == nil && rd.Params == nil && rd.Patterns == nil && rd.JSONPaths == nil {
+		return nil
+	}
+	return rd
+}
+
 //=================================
 // program startup
 //=================================
@@ -403,6 +621,11 @@ func runMain() (err error) {
 	// command-line options
 	//
 
+	// subcommands
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		return runCA(os.Args[2:])
+	}
+
 	// help text
 	flag.Usage = func() {
 		o := flag.CommandLine.Output()
@@ -410,7 +633,8 @@ func runMain() (err error) {
 		fmt.Fprintf(o, "\nA HTTP(s) capturing proxy that write contents of HTTP(s) to files.\n")
 		fmt.Fprintf(o, "\t2021 github.com/mixcode\n\n")
 
-		fmt.Fprintf(o, "Usage: %s [options] RootCA_pem_file [privkey_pem_file]\n\nOptions:\n", os.Args[0])
+		fmt.Fprintf(o, "Usage: %s [options] RootCA_pem_file [privkey_pem_file]\n", os.Args[0])
+		fmt.Fprintf(o, "       %s ca info|export|install [options] [RootCA_pem_file [privkey_pem_file]]\n\nOptions:\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
@@ -420,6 +644,61 @@ func runMain() (err error) {
 	// -use-builtin-cert: use built-in cert
 	flag.BoolVar(&useBuiltinCert, "use-builtin-cert", useBuiltinCert, "use the built-in Root CA cert (To get the built-in cert, use -print-builtin-cert flag)")
 
+	// -users: users of the proxy
+	flag.StringVar(&usersFile, "users", usersFile, "a file of `user:password` lines; the clients must authenticate to the proxy with one of them (Proxy-Authorization Basic). passwords may be bcrypt hashes of 'htpasswd -B'")
+
+	// -allow-clients, -deny-clients: IP ranges of the clients
+	flag.StringVar(&allowClients, "allow-clients", allowClients, "comma-separated IP ranges in CIDR of the clients allowed to use the proxy (e.g. 127.0.0.1,192.168.1.0/24). all clients if empty")
+	flag.StringVar(&denyClients, "deny-clients", denyClients, "comma-separated IP ranges in CIDR of the clients denied, even if allowed by -allow-clients")
+
+	// -tag-header: a request header tagging the sessions
+	flag.StringVar(&tagHeader, "tag-header", tagHeader, "a request header tagging the session with its value, e.g. X-Capture-Tag. the header is not forwarded to the servers")
+
+	// -route: route the sessions of matching clients to a subdirectory
+	flag.Func("route", "save the sessions of matching clients to a subdirectory NAME of the capture directory with its own log, in `NAME=ip:CIDR,...`, NAME=user:USER,... or NAME=tag:TAG,... may be repeated; the first matching one is used", func(s string) error {
+		r, err := parseRoute(s)
+		if err == nil {
+			routes = append(routes, r)
+		}
+		return err
+	})
+
+	// -route-by: route the other sessions by the client
+	flag.StringVar(&routeBy, "route-by", routeBy, "save the sessions not matching -route to a subdirectory per client ip, user or tag")
+	flag.IntVar(&maxRoutes, "max-routes", maxRoutes, "max number of the subdirectories made by -route-by. the sessions of further clients stay in the capture directory")
+
+	// -redact: redact the secrets before the sessions are written
+	flag.BoolVar(&redact, "redact", redact, "redact secrets in the headers (e.g. Authorization, Cookie), the URL params and the bodies (e.g. password) before the sessions are written")
+	flag.StringVar(&redactMode, "redact-mode", redactMode, "replace the secrets with REDACTED (mask), or with REDACTED-HASH of a keyed hash, so equal secrets are still equal (hash)")
+	flag.StringVar(&redactKey, "redact-key", redactKey, "key of -redact-mode hash. a random key per run if empty")
+
+	// -redact-headers, -redact-params: names of the secrets, in addition to the built-in lists
+	flag.StringVar(&redactHeaders, "redact-headers", redactHeaders, "comma-separated headers to be redacted, in addition to the built-in list. implies -redact")
+	flag.StringVar(&redactParams, "redact-params", redactParams, "comma-separated query, form and multipart params, and JSON keys to be redacted, in addition to the built-in list. implies -redact")
+
+	// -redact-pattern: patterns of the secrets in the bodies
+	flag.Func("redact-pattern", "a `REGEX` in the bodies to be redacted; the first group if any, or the whole match. 'jwt' and 'card' for JSON Web Tokens and card numbers. may be repeated. implies -redact", func(s string) error {
+		switch s {
+		case "jwt":
+			redactPatterns = append(redactPatterns, httpscapture.RedactJWT)
+		case "card":
+			redactPatterns = append(redactPatterns, httpscapture.RedactCardNumber)
+		default:
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return err
+			}
+			redactPatterns = append(redactPatterns, re)
+		}
+		return nil
+	})
+
+	// -redact-json: JSON paths of the secrets
+	flag.Func("redact-json", "a `PATH` of JSON values to be redacted, e.g. '$.user.password', '$.items[*].card' or '$..token'. may be repeated. implies -redact", func(s string) error {
+		redactJSONPaths = append(redactJSONPaths, s)
+		return nil
+	})
+
 	// -dir: log dir
 	flag.StringVar(&captureDir, "dir", defaultCaptureDir, "directory to store the captured files")
 	// -log: log list file
@@ -435,11 +714,48 @@ func runMain() (err error) {
 	flag.BoolVar(&rawPostForm, "rawform", rawPostForm, "log x-www-form-urlencoded forms in raw query string")
 
 	// -rawbody: save req/resp bodies in its raw (maybe compressed) form
-	//flag.BoolVar(&rawCompressedBody, "rawbody", rawCompressedBody, "save req/resp podies in its raw (maybe compressed) form")
+	flag.BoolVar(&rawCompressedBody, "rawbody", rawCompressedBody, "also save compressed req/resp bodies in its raw form, along with the decoded form")
+
+	// -utf8: save text bodies transcoded to UTF-8
+	flag.BoolVar(&saveUTF8, "utf8", saveUTF8, "also save text bodies in other charsets (e.g. Shift_JIS) transcoded to UTF-8")
+
+	// -pretty: pretty-print the bodies
+	flag.BoolVar(&prettyPrint, "pretty", prettyPrint, "pretty-print JSON, XML and form bodies in the log, and save extra .pretty files")
+
+	// -grpc-descriptors: descriptors of the gRPC messages
+	flag.StringVar(&grpcDescriptorFile, "grpc-descriptors", grpcDescriptorFile, "a FileDescriptorSet to decode gRPC messages to JSON (protoc --include_imports --descriptor_set_out=FILE)")
+
+	// upstream certs
+	flag.StringVar(&upstreamVerify, "upstream-verify", upstreamVerify, "verification of the server certs: insecure, warn (record it and give the client an untrusted cert), or strict (fail the request)")
+	flag.StringVar(&upstreamCAFile, "upstream-ca", upstreamCAFile, "a PEM file of additional trusted Root CAs of the servers (e.g. an internal CA)")
+	flag.Func("client-cert", "a client cert for mutual TLS to the servers, in `PATTERN=CERT[,KEY]` (e.g. '*.internal.corp=client.pem,client-key.pem' or 'api.corp=client.p12'). may be repeated", func(s string) error {
+		clientCertSpecs = append(clientCertSpecs, s)
+		return nil
+	})
+	flag.StringVar(&clientCertPass, "client-cert-pass", clientCertPass, "password of PKCS#12 client certs")
+	flag.BoolVar(&requestClientCert, "request-client-cert", requestClientCert, "ask the clients for a cert, to record what they offer")
 
 	// -tee
 	flag.BoolVar(&tee, "tee", tee, "print logs to stdout along with the logfile")
 
+	// -jsonl: JSON Lines output of the sessions
+	flag.StringVar(&jsonlFileName, "jsonl", jsonlFileName, "also write finished sessions to this file in JSON Lines ('-' for stdout)")
+	flag.BoolVar(&jsonlBodies, "jsonl-bodies", jsonlBodies, "include decoded bodies in base64 in the JSONL output")
+
+	// -har: HAR output of the sessions
+	flag.StringVar(&harFileName, "har", harFileName, "also write finished sessions to this file in HAR format on exit")
+
+	// -tui
+	flag.BoolVar(&useTUI, "tui", useTUI, "show live sessions in a terminal UI, instead of printing logs to stdout")
+
+	// -ui-addr: web UI listen address
+	flag.StringVar(&uiListenAddress, "ui-addr", uiListenAddress, "listen address of the built-in web UI, on a loopback address (e.g. localhost:38081). disabled if empty")
+	flag.IntVar(&uiHistoryMax, "ui-history", uiHistoryMax, "max number of sessions kept in memory for the web UI and the terminal UI")
+
+	// -api-addr: control API listen address
+	flag.StringVar(&apiListenAddress, "api-addr", apiListenAddress, "listen address of the local control API (e.g. localhost:38082). disabled if empty")
+	flag.StringVar(&apiToken, "api-token", apiToken, "bearer token of the control API. a random token is generated and printed if empty")
+
 	// -v
 	flag.BoolVar(&verbose, "v", verbose, "verbose; print internal proxy log to stdout")
 
@@ -450,6 +766,17 @@ func runMain() (err error) {
 	var genCertFlag = false
 	flag.BoolVar(&genCertFlag, "generate-cert", false, "generate a self-signed Root CA cert using built-in (insecure) default key and write it to given filename")
 
+	// MITM certs
+	flag.BoolVar(&certPage, "cert-page", certPage, "serve a page to download the CA cert to the proxied clients at http://"+httpscapture.CertPageHost+"/")
+	flag.StringVar(&leafKey, "leaf-key", leafKey, "key type of the MITM certs: ecdsa (P-256) or rsa (RSA 2048 bits). follows the CA key type if empty")
+	flag.DurationVar(&leafValidity, "leaf-validity", leafValidity, "validity of the MITM certs, e.g. 24h. 30 days if 0")
+	flag.BoolVar(&mirrorUpstream, "mirror-upstream", mirrorUpstream, "copy the subject, SANs and validity of the server certs to the MITM certs")
+
+	// name constraints of a generated CA
+	flag.StringVar(&permittedDNS, "permitted-dns", permittedDNS, "with -generate-cert, limit the CA to these comma-separated domains and their subdomains (X.509 name constraints)")
+	flag.StringVar(&permittedIP, "permitted-ip", permittedIP, "with -generate-cert, limit the CA to these comma-separated IP ranges in CIDR. IP addresses are not permitted at all if only -permitted-dns is given, and vice versa")
+	flag.StringVar(&outsideConstraints, "outside-constraints", outsideConstraints, "handling of the hosts outside the name constraints of the CA: tunnel (pass through without capturing) or refuse")
+
 	// -print-builtin-cert : print the default built-in CA cert to a file
 	var printCertFlag = false
 	flag.BoolVar(&printCertFlag, "print-builtin-cert", false, "write the built-in default insecure Root CA to a file")
@@ -485,19 +812,22 @@ func runMain() (err error) {
 		for _, p := range s {
 			portnum, e := strconv.Atoi(strings.TrimSpace(p))
 			if e == nil {
-				nonTLSPort[portnum] = true
+				nonTLSPorts = append(nonTLSPorts, portnum)
 			}
 		}
 
-		// set log file name
-		logFileName = filepath.Join(captureDir, defaultLogFileName)
+		// set log file name, if not given by -log
+		logFlag := false
+		flag.Visit(func(f *flag.Flag) {
+			logFlag = logFlag || f.Name == "log"
+		})
+		if !logFlag {
+			logFileName = filepath.Join(captureDir, defaultLogFileName)
+		}
 
 		// set content type match
 		if contentTypes != "" {
-			saveContentType = make(map[string]bool)
-			for _, s := range strings.Split(contentTypes, ",") {
-				saveContentType[s] = true
-			}
+			saveContentTypes = strings.Split(contentTypes, ",")
 		}
 
 		// filename match
@@ -506,8 +836,32 @@ func runMain() (err error) {
 			if e != nil {
 				return e
 			}
-			saveIfMatch = make([]*regexp.Regexp, 1)
-			saveIfMatch[0] = m
+			saveIfMatch = []*regexp.Regexp{m}
+		}
+
+		// the terminal UI owns the stdout
+		if useTUI {
+			if logFileName == "-" {
+				return fmt.Errorf("-tui cannot be used with the log written to stdout")
+			}
+			tee = false
+		}
+
+		// the session history is only used by the web UI and the API
+		if uiListenAddress != "" || apiListenAddress != "" {
+			historyMax = uiHistoryMax
+		}
+		if uiListenAddress != "" {
+			err = prepareWebUI()
+			if err != nil {
+				return
+			}
+		}
+		if apiListenAddress != "" {
+			err = prepareAPI()
+			if err != nil {
+				return
+			}
 		}
 
 		// run proxy
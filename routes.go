@@ -0,0 +1,84 @@
+package main
+
+//
+// Routing of the sessions to per-client directories and logs
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mixcode/https_capture/httpscapture"
+)
+
+// parse a routing rule in NAME=KIND:VALUE[,VALUE...], where KIND is ip, user or tag
+func parseRoute(spec string) (r *httpscapture.Route, err error) {
+	name, rule, ok := strings.Cut(spec, "=")
+	kind, values, ok2 := strings.Cut(rule, ":")
+	if !ok || !ok2 || name == "" || values == "" {
+		return nil, fmt.Errorf("invalid route %q; must be in NAME=ip:CIDR,..., NAME=user:USER,... or NAME=tag:TAG,...", spec)
+	}
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid route name %q; must be a directory name", name)
+	}
+	r = &httpscapture.Route{Name: name}
+	switch kind {
+	case httpscapture.RouteByIP:
+		r.Clients, err = parseIPRanges(values)
+		if err != nil {
+			return nil, err
+		}
+	case httpscapture.RouteByUser:
+		r.Users = strings.Split(values, ",")
+	case httpscapture.RouteByTag:
+		r.Tags = strings.Split(values, ",")
+	default:
+		return nil, fmt.Errorf("unknown kind of route %q; must be ip, user or tag", kind)
+	}
+	return
+}
+
+// the text log of a route, closed with the sink
+type routeLog struct {
+	*httpscapture.TextSink
+	f *logFile
+}
+
+func (l *routeLog) Close() error {
+	return l.f.Close()
+}
+
+// sinks of the routes; the sessions of a route are saved to the subdirectory and its own log.
+// The sessions without a route are given to defaultSinks.
+func newRouteSink(defaultSinks []httpscapture.Sink) *httpscapture.RouteSink {
+	return &httpscapture.RouteSink{New: func(route string) ([]httpscapture.Sink, error) {
+		if route == "" {
+			return defaultSinks, nil
+		}
+		dir := filepath.Join(captureDir, route)
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+		f, err := openRouteLogFile(filepath.Join(dir, defaultLogFileName))
+		if err != nil {
+			return nil, err
+		}
+		var w io.Writer = f
+		if tee {
+			w = io.MultiWriter(f, os.Stdout)
+		}
+		if verbose {
+			fmt.Printf("sessions of route '%s' are saved to %s\n", route, dir)
+		}
+		return []httpscapture.Sink{
+			&httpscapture.FileSink{Dir: dir, RawPostForm: rawPostForm},
+			&routeLog{TextSink: &httpscapture.TextSink{W: w, RawPostForm: rawPostForm}, f: f},
+		}, nil
+	}}
+}
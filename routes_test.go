@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	r, err := parseRoute("lab=ip:10.0.0.0/8,192.168.1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "lab" || len(r.Clients) != 2 || r.Clients[1].String() != "192.168.1.5/32" {
+		t.Errorf("invalid route: %s %v", r.Name, r.Clients)
+	}
+	r, err = parseRoute("qa=tag:qa,smoke")
+	if err != nil || len(r.Tags) != 2 || r.Tags[1] != "smoke" {
+		t.Errorf("invalid route: %v %v", r, err)
+	}
+	for _, spec := range []string{"alice", "a=user:", "a=host:x", "../x=user:a", "a=ip:10.0.0.0/33"} {
+		if _, err := parseRoute(spec); err == nil {
+			t.Errorf("%s: accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+//
+// A terminal UI for live session monitoring
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+	"golang.org/x/text/width"
+
+	"github.com/mixcode/https_capture/httpscapture"
+)
+
+const (
+	tuiRefreshInterval = 100 * time.Millisecond
+	tuiPreviewBytes    = 4096 // max body bytes shown in the detail pane
+)
+
+var (
+	useTUI = false // -tui
+)
+
+// ANSI escape sequences
+const (
+	ansiAltScreen    = "\x1b[?1049h"
+	ansiNormalScreen = "\x1b[?1049l"
+	ansiHideCursor   = "\x1b[?25l"
+	ansiShowCursor   = "\x1b[?25h"
+	ansiHome         = "\x1b[H"
+	ansiClearLine    = "\x1b[K"
+	ansiClearBelow   = "\x1b[J"
+	ansiReset        = "\x1b[0m"
+	ansiReverse      = "\x1b[7m"
+	ansiBold         = "\x1b[1m"
+	ansiRed          = "\x1b[31m"
+	ansiGreen        = "\x1b[32m"
+	ansiYellow       = "\x1b[33m"
+	ansiCyan         = "\x1b[36m"
+	ansiGrey         = "\x1b[90m"
+)
+
+// keys
+const (
+	keyUp = iota + 256
+	keyDown
+	keyPgUp
+	keyPgDn
+	keyHome
+	keyEnd
+	keyEsc
+)
+
+type tui struct {
+	out *bufio.Writer
+
+	sessions []*httpscapture.SessionRecord // sessions in order of id
+	index    map[int64]int                 // session id to index of sessions
+	pending  []*httpscapture.SessionRecord // sessions updated while paused, latest per id
+	view     []*httpscapture.SessionRecord // filtered sessions
+	paused   bool                          // do not update the list
+	follow   bool                          // keep the last session selected
+	selected int                           // selected index of view
+	top      int                           // first visible index of view
+	filter   string                        // current filter
+	editing  bool                          // editing the filter
+	editBuf  string                        // filter being edited
+	scroll   int                           // scroll offset of the detail pane
+	dirty    bool                          // needs to redraw
+	width    int                           // terminal size
+	height   int                           // terminal size
+	limit    int                           // max number of sessions kept
+
+	pendingIndex map[int64]int // session id to index of pending
+	evicted      int64         // last id of the sessions removed by limit
+}
+
+func newTUI(w io.Writer, limit int) *tui {
+	return &tui{out: bufio.NewWriter(w), index: make(map[int64]int), follow: true, limit: limit}
+}
+
+// run the terminal UI until stop is closed or the user quits.
+// The proxy is stopped with a nil error when the user quits the UI.
+func runTUI(stop chan struct{}) (err error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("-tui requires a terminal")
+	}
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return
+	}
+	defer term.Restore(fd, oldState)
+
+	t := newTUI(os.Stdout, uiHistoryMax)
+	t.out.WriteString(ansiAltScreen + ansiHideCursor)
+	defer func() {
+		t.out.WriteString(ansiReset + ansiShowCursor + ansiNormalScreen)
+		t.out.Flush()
+	}()
+
+	ch := proxy.Subscribe()
+	defer proxy.Unsubscribe(ch)
+
+	chKey := make(chan int, 16)
+	go readKeys(os.Stdin, chKey)
+
+	ticker := time.NewTicker(tuiRefreshInterval)
+	defer ticker.Stop()
+
+	t.dirty = true
+	for {
+		select {
+		case <-stop:
+			return
+
+		case rec := <-ch:
+			t.add(rec)
+
+		case k, ok := <-chKey:
+			if !ok {
+				chKey = nil // stdin closed
+				continue
+			}
+			if !t.key(k) {
+				stopProxy(nil) // quit the proxy
+				<-stop
+				return
+			}
+
+		case <-ticker.C:
+			w, h, e := term.GetSize(fd)
+			if e == nil && (w != t.width || h != t.height) {
+				t.width, t.height = w, h
+				t.dirty = true
+			}
+			if t.dirty {
+				t.draw()
+				t.dirty = false
+			}
+		}
+	}
+}
+
+// read key strokes from a raw terminal
+func readKeys(r io.Reader, ch chan int) {
+	buf := make([]byte, 64)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			close(ch)
+			return
+		}
+		b := buf[:n]
+		for len(b) > 0 {
+			if b[0] == 0x1b {
+				// escape sequences
+				seq := map[string]int{
+					"\x1b[A": keyUp, "\x1b[B": keyDown,
+					"\x1b[5~": keyPgUp, "\x1b[6~": keyPgDn,
+					"\x1b[H": keyHome, "\x1b[F": keyEnd,
+					"\x1b[1~": keyHome, "\x1b[4~": keyEnd,
+				}
+				found := false
+				for s, k := range seq {
+					if strings.HasPrefix(string(b), s) {
+						ch <- k
+						b = b[len(s):]
+						found = true
+						break
+					}
+				}
+				if !found {
+					ch <- keyEsc
+					if len(b) > 1 && b[1] == '[' {
+						// unknown sequence; skip it
+						b = b[:0]
+					} else {
+						b = b[1:]
+					}
+				}
+				continue
+			}
+			rn, sz := utf8.DecodeRune(b)
+			ch <- int(rn)
+			b = b[sz:]
+		}
+	}
+}
+
+// add or update a session
+func (t *tui) add(rec *httpscapture.SessionRecord) {
+	if rec.Id <= t.evicted {
+		// already removed by limit
+		return
+	}
+	if t.paused {
+		t.addPending(rec)
+		return
+	}
+	if i, ok := t.index[rec.Id]; ok {
+		t.sessions[i] = rec
+	} else {
+		// keep the sessions in order of id
+		i := sort.Search(len(t.sessions), func(i int) bool { return t.sessions[i].Id > rec.Id })
+		t.sessions = append(t.sessions, nil)
+		copy(t.sessions[i+1:], t.sessions[i:])
+		t.sessions[i] = rec
+		if len(t.sessions) > t.limit {
+			n := len(t.sessions) - t.limit
+			t.evicted = t.sessions[n-1].Id
+			t.sessions = t.sessions[n:]
+		}
+		t.reindex()
+	}
+	t.refilter()
+}
+
+// keep the latest update of a session while paused, up to limit sessions
+func (t *tui) addPending(rec *httpscapture.SessionRecord) {
+	if i, ok := t.pendingIndex[rec.Id]; ok {
+		t.pending[i] = rec
+		return
+	}
+	t.pending = append(t.pending, rec)
+	if len(t.pending) > t.limit {
+		t.pending = t.pending[len(t.pending)-t.limit:]
+	}
+	t.pendingIndex = make(map[int64]int)
+	for i, r := range t.pending {
+		t.pendingIndex[r.Id] = i
+	}
+}
+
+func (t *tui) reindex() {
+	t.index = make(map[int64]int)
+	for i, r := range t.sessions {
+		t.index[r.Id] = i
+	}
+}
+
+// rebuild the filtered view
+func (t *tui) refilter() {
+	var selectedId int64 = -1
+	if t.selected < len(t.view) {
+		selectedId = t.view[t.selected].Id
+	}
+	t.view = t.view[:0]
+	f := strings.ToLower(t.filter)
+	for _, r := range t.sessions {
+		if f == "" || strings.Contains(strings.ToLower(tuiSummary(r)), f) {
+			t.view = append(t.view, r)
+		}
+	}
+	if t.follow {
+		t.selected = len(t.view) - 1
+	} else {
+		i := sort.Search(len(t.view), func(i int) bool { return t.view[i].Id >= selectedId })
+		t.selected = i
+	}
+	t.clampSelection()
+	t.dirty = true
+}
+
+func (t *tui) clampSelection() {
+	if t.selected >= len(t.view) {
+		t.selected = len(t.view) - 1
+	}
+	if t.selected < 0 {
+		t.selected = 0
+	}
+}
+
+// handle a key stroke. returns false to quit.
+func (t *tui) key(k int) bool {
+	t.dirty = true
+	if t.editing {
+		switch k {
+		case '\r', '\n':
+			t.editing = false
+			t.filter = t.editBuf
+			t.refilter()
+		case keyEsc, 0x03:
+			t.editing = false
+		case 0x7f, 0x08:
+			if len(t.editBuf) > 0 {
+				_, sz := utf8.DecodeLastRuneInString(t.editBuf)
+				t.editBuf = t.editBuf[:len(t.editBuf)-sz]
+			}
+		default:
+			if k >= 0x20 && k < keyUp {
+				t.editBuf += string(rune(k))
+			}
+		}
+		return true
+	}
+
+	page := t.listHeight() - 1
+	if page < 1 {
+		page = 1
+	}
+	move := func(d int) {
+		t.selected += d
+		t.clampSelection()
+		t.follow = t.selected == len(t.view)-1
+		t.scroll = 0
+	}
+	switch k {
+	case 'q', 0x03: // q, ctrl-c
+		return false
+	case keyUp, 'k':
+		move(-1)
+	case keyDown, 'j':
+		move(1)
+	case keyPgUp:
+		move(-page)
+	case keyPgDn:
+		move(page)
+	case keyHome, 'g':
+		move(-len(t.view))
+	case keyEnd, 'G':
+		move(len(t.view))
+	case 'J':
+		t.scroll++
+	case 'K':
+		if t.scroll > 0 {
+			t.scroll--
+		}
+	case '/':
+		t.editing = true
+		t.editBuf = t.filter
+	case keyEsc:
+		t.filter = ""
+		t.refilter()
+	case 'p', ' ':
+		t.paused = !t.paused
+		if !t.paused {
+			pending := t.pending
+			t.pending, t.pendingIndex = nil, nil
+			for _, r := range pending {
+				t.add(r)
+			}
+		}
+	}
+	return true
+}
+
+func (t *tui) listHeight() int {
+	h := (t.height - 3) * 3 / 5
+	if h < 3 {
+		h = 3
+	}
+	return h
+}
+
+// redraw the screen
+func (t *tui) draw() {
+	if t.width <= 0 || t.height <= 0 {
+		return
+	}
+	o := t.out
+	o.WriteString(ansiHome)
+	line := func(color, s string) {
+		o.WriteString(color)
+		o.WriteString(fitWidth(s, t.width))
+		o.WriteString(ansiReset + ansiClearLine + "\r\n")
+	}
+
+	// title
+	state := "live"
+	if t.paused {
+		state = fmt.Sprintf("PAUSED (%d new)", len(t.pending))
+	}
+	title := fmt.Sprintf(" https_capture  %d/%d sessions  [%s]", len(t.view), len(t.sessions), state)
+	if t.filter != "" {
+		title += "  filter: " + t.filter
+	}
+	line(ansiReverse, padWidth(title, t.width))
+
+	// session list
+	lh := t.listHeight()
+	if t.selected < t.top {
+		t.top = t.selected
+	}
+	if t.selected >= t.top+lh {
+		t.top = t.selected - lh + 1
+	}
+	for i := t.top; i < t.top+lh; i++ {
+		if i >= len(t.view) {
+			line("", "")
+			continue
+		}
+		r := t.view[i]
+		color := tuiStatusColor(r)
+		if i == t.selected {
+			color += ansiReverse
+		}
+		line(color, padWidth(tuiSummary(r), t.width))
+	}
+
+	// detail pane
+	line(ansiGrey, strings.Repeat("-", t.width))
+	dh := t.height - lh - 3
+	var detail []string
+	if t.selected < len(t.view) {
+		detail = tuiDetail(t.view[t.selected])
+	}
+	if t.scroll > len(detail)-1 {
+		t.scroll = len(detail) - 1
+	}
+	if t.scroll < 0 {
+		t.scroll = 0
+	}
+	for i := 0; i < dh; i++ {
+		if t.scroll+i < len(detail) {
+			line("", detail[t.scroll+i])
+		} else {
+			line("", "")
+		}
+	}
+
+	// help or filter input
+	if t.editing {
+		o.WriteString(ansiBold + fitWidth("filter: "+t.editBuf+"_", t.width) + ansiReset + ansiClearLine)
+	} else {
+		o.WriteString(ansiGrey + fitWidth(" q:quit  j/k:move  J/K:scroll detail  /:filter  esc:clear filter  p:pause/resume", t.width) + ansiReset + ansiClearLine)
+	}
+	o.WriteString(ansiClearBelow)
+	o.Flush()
+}
+
+// one-line summary of a session
+func tuiSummary(r *httpscapture.SessionRecord) string {
+	status := r.State
+	if r.StatusCode != 0 && r.State != httpscapture.StateFailed {
+		status = fmt.Sprintf("%d", r.StatusCode)
+	}
+	d := ""
+	if r.Duration() > 0 {
+		d = r.Duration().Round(time.Millisecond).String()
+	}
+	return fmt.Sprintf("%6d %s %-7s %-8s %8d %8s %s%s", r.Id, r.Start.Format("15:04:05"), r.Method, status, r.RespSize, d, r.Host, r.Path)
+}
+
+func tuiStatusColor(r *httpscapture.SessionRecord) string {
+	switch {
+	case r.State == httpscapture.StateFailed || r.StatusCode >= 500:
+		return ansiRed
+	case r.StatusCode >= 400:
+		return ansiYellow
+	case r.StatusCode >= 300:
+		return ansiCyan
+	case r.StatusCode >= 200:
+		return ansiGreen
+	}
+	return ansiGrey
+}
+
+// lines of the detail pane
+func tuiDetail(r *httpscapture.SessionRecord) (lines []string) {
+	lines = append(lines, fmt.Sprintf("[%d] %s %s", r.Id, r.Method, r.URL))
+	if r.Error != "" {
+		lines = append(lines, "error: "+r.Error)
+	}
+	if r.Timings != nil {
+		lines = append(lines, "timings: "+r.Timings.String())
+	}
+	if r.User != "" {
+		lines = append(lines, fmt.Sprintf("client: %s, user %s", r.ClientAddr, r.User))
+	} else if r.ClientAddr != "" {
+		lines = append(lines, "client: "+r.ClientAddr)
+	}
+	if r.Tag != "" {
+		lines = append(lines, "tag: "+r.Tag)
+	}
+	if h := r.ClientHello; h != nil {
+		lines = append(lines, fmt.Sprintf("client TLS: sni %q, ja3 %s, ja4 %s", h.ServerName, h.JA3Hash, h.JA4))
+	}
+	if t := r.UpstreamTLS; t != nil {
+		lines = append(lines, fmt.Sprintf("server: %s, %s, %s", r.ServerAddr, t.Version, t.CipherSuite))
+		for i, c := range t.Certificates {
+			lines = append(lines, fmt.Sprintf("  cert %d: %s, expires %s", i, c.Subject, c.NotAfter.Format("2006-01-02")))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("==== Req (%s): headers ====", r.Proto))
+	lines = append(lines, headerLines(r.ReqHeader)...)
+	if r.ReqBody != nil && len(r.ReqBody.Data) > 0 {
+		lines = append(lines, "---- Req: body ----")
+		lines = append(lines, bodyPreview(r.ReqBody.Text())...)
+	}
+	if len(r.ReqTrailer) > 0 {
+		lines = append(lines, "==== Req: trailers ====")
+		lines = append(lines, headerLines(r.ReqTrailer)...)
+	}
+	if r.Status != "" {
+		lines = append(lines, fmt.Sprintf("==== Resp (%s %s): headers ====", r.UpstreamProto, r.Status))
+		lines = append(lines, headerLines(r.RespHeader)...)
+	}
+	if r.RespBody != nil && len(r.RespBody.Data) > 0 {
+		lines = append(lines, "---- Resp: body ----")
+		lines = append(lines, bodyPreview(r.RespBody.Text())...)
+	}
+	if len(r.RespTrailer) > 0 {
+		lines = append(lines, "==== Resp: trailers ====")
+		lines = append(lines, headerLines(r.RespTrailer)...)
+	}
+	return
+}
+
+func headerLines(h map[string][]string) []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("  %s: %v", k, h[k]))
+	}
+	return lines
+}
+
+// preview of a body; text as-is, binary in hex
+func bodyPreview(body []byte) (lines []string) {
+	b := body
+	if len(b) > tuiPreviewBytes {
+		b = b[:tuiPreviewBytes]
+	}
+	if utf8.Valid(b) {
+		for _, s := range strings.Split(string(b), "\n") {
+			lines = append(lines, "  "+strings.TrimRight(s, "\r"))
+		}
+	} else {
+		for i := 0; i < len(b); i += 16 {
+			end := i + 16
+			if end > len(b) {
+				end = len(b)
+			}
+			lines = append(lines, fmt.Sprintf("  %08x  % x", i, b[i:end]))
+		}
+	}
+	if len(body) > len(b) {
+		lines = append(lines, fmt.Sprintf("  ... (%d more bytes)", len(body)-len(b)))
+	}
+	return
+}
+
+// cut a string to fit in a display width, and replace control chars
+func fitWidth(s string, width int) string {
+	var sb strings.Builder
+	n := 0
+	for _, c := range s {
+		c = printableRune(c)
+		w := runeWidth(c)
+		if n+w > width {
+			break
+		}
+		sb.WriteRune(c)
+		n += w
+	}
+	return sb.String()
+}
+
+// a rune safe to be written to the terminal; control chars, including C1 and bidi controls, are replaced
+func printableRune(c rune) rune {
+	if c == '\t' {
+		return ' '
+	}
+	if unicode.IsControl(c) || unicode.Is(unicode.Bidi_Control, c) {
+		return '.'
+	}
+	return c
+}
+
+// display width of a rune in the terminal
+func runeWidth(c rune) int {
+	if unicode.In(c, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+	switch width.LookupRune(c).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
+
+// display width of a string in the terminal
+func stringWidth(s string) (n int) {
+	for _, c := range s {
+		n += runeWidth(printableRune(c))
+	}
+	return
+}
+
+// pad a string with spaces to a width
+func padWidth(s string, width int) string {
+	n := stringWidth(s)
+	if n < width {
+		s += strings.Repeat(" ", width-n)
+	}
+	return s
+}
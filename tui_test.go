@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/mixcode/https_capture/httpscapture"
+)
+
+func TestTUIList(t *testing.T) {
+
+	u := newTUI(io.Discard, 3)
+	for i := int64(1); i <= 4; i++ {
+		u.add(&httpscapture.SessionRecord{Id: i, Method: "GET", Host: "example.com", Path: "/", State: httpscapture.StateRequest})
+	}
+	// only the latest sessions are kept
+	if len(u.sessions) != 3 || u.sessions[0].Id != 2 {
+		t.Fatalf("invalid session list")
+	}
+	// update an existing session
+	u.add(&httpscapture.SessionRecord{Id: 3, Method: "GET", Host: "example.com", Path: "/", State: httpscapture.StateClosed, StatusCode: 404})
+	if len(u.sessions) != 3 || u.sessions[u.index[3]].StatusCode != 404 {
+		t.Fatalf("session not updated")
+	}
+	// following the last session
+	if u.view[u.selected].Id != 4 {
+		t.Errorf("last session not selected")
+	}
+
+	// filter
+	for _, k := range "/404\r" {
+		u.key(int(k))
+	}
+	if len(u.view) != 1 || u.view[0].Id != 3 {
+		t.Errorf("filter not applied")
+	}
+	u.key(keyEsc)
+	if len(u.view) != 3 {
+		t.Errorf("filter not cleared")
+	}
+
+	// pause and resume
+	u.key('p')
+	u.add(&httpscapture.SessionRecord{Id: 5, State: httpscapture.StateRequest})
+	if len(u.sessions) != 3 || len(u.pending) != 1 {
+		t.Errorf("list updated while paused")
+	}
+	u.key('p')
+	if u.sessions[len(u.sessions)-1].Id != 5 || len(u.pending) != 0 {
+		t.Errorf("pending sessions not applied")
+	}
+
+	// updates while paused are kept per session, up to the limit
+	u.key('p')
+	for i := int64(6); i <= 10; i++ {
+		u.add(&httpscapture.SessionRecord{Id: i, State: httpscapture.StateRequest})
+		u.add(&httpscapture.SessionRecord{Id: i, State: httpscapture.StateClosed})
+	}
+	if len(u.pending) != 3 || u.pending[0].Id != 8 || u.pending[0].State != httpscapture.StateClosed {
+		t.Errorf("invalid pending sessions: %d", len(u.pending))
+	}
+	u.key('p')
+
+	// an update of a removed session is dropped, and the sessions are kept in order
+	u.add(&httpscapture.SessionRecord{Id: 2, State: httpscapture.StateClosed})
+	if len(u.sessions) != 3 || u.sessions[0].Id != 8 || u.sessions[2].Id != 10 {
+		t.Errorf("a removed session is added again")
+	}
+
+	// quit
+	if u.key('q') {
+		t.Errorf("quit key not handled")
+	}
+}
+
+func TestFitWidth(t *testing.T) {
+	for _, c := range []struct {
+		s     string
+		width int
+		fit   string
+	}{
+		{"abcdef", 4, "abcd"},
+		{"日本語テキスト", 5, "日本"},
+		{"a日本", 4, "a日"},
+		{"étude", 3, "étu"},
+		{"\x1b[2J\u009b2J\u202eab", 20, ".[2J.2J.ab"},
+		{"a\tb", 3, "a b"},
+	} {
+		if s := fitWidth(c.s, c.width); s != c.fit {
+			t.Errorf("%q: %q, expected %q", c.s, s, c.fit)
+		}
+	}
+	if s := padWidth("日本", 6); s != "日本  " {
+		t.Errorf("padded to %q", s)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+//
+// A built-in web UI to browse live and past sessions
+//
+// github.com/mixcode, 2021-04
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mixcode/https_capture/httpscapture"
+
+	_ "embed"
+)
+
+//go:embed webui.html
+var webUIPage []byte
+
+var (
+	// web UI listen address. empty to disable the UI.
+	uiListenAddress = ""
+
+	// max number of sessions kept in the UIs
+	uiHistoryMax = 1000
+
+	// max number of sessions kept in the proxy. 0 if no UI uses the history.
+	historyMax = 0
+)
+
+// check the web UI address is a loopback address; the UI shows every captured secret
+func prepareWebUI() error {
+	host, _, err := net.SplitHostPort(uiListenAddress)
+	if err != nil {
+		return err
+	}
+	if !isLoopback(host) {
+		return fmt.Errorf("the web UI must listen on a loopback address: %s", uiListenAddress)
+	}
+	return nil
+}
+
+// create the handler of the web UI
+func newWebUIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", webUIIndex)
+	mux.HandleFunc("/api/sessions", webUISessionList)
+	mux.HandleFunc("/api/sessions/", webUISession)
+	mux.HandleFunc("/api/events", webUIEvents)
+	mux.HandleFunc("/files/", webUIFile)
+
+	_, port, _ := net.SplitHostPort(uiListenAddress)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only the loopback hosts of the port, against DNS rebinding
+		host, p, err := net.SplitHostPort(r.Host)
+		if err != nil || p != port || !isLoopback(host) {
+			http.Error(w, "forbidden host", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// GET / : the UI page
+func webUIIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(webUIPage)
+}
+
+// GET /api/sessions : list of sessions in the history
+func webUISessionList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, proxy.Sessions())
+}
+
+// GET /api/sessions/{id} : a session
+// GET /api/sessions/{id}/req : the decoded request body
+// GET /api/sessions/{id}/resp : the decoded response body
+func webUISession(w http.ResponseWriter, r *http.Request) {
+	a := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/sessions/"), "/")
+	id, e := strconv.ParseInt(a[0], 10, 64)
+	if e != nil {
+		http.NotFound(w, r)
+		return
+	}
+	rec := proxy.Session(id)
+	if rec == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if len(a) == 1 {
+		writeJSON(w, rec)
+		return
+	}
+
+	var body *httpscapture.Body
+	switch a[1] {
+	case "req":
+		body = rec.ReqBody
+	case "resp":
+		body = rec.RespBody
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if body == nil {
+		http.NotFound(w, r)
+		return
+	}
+	// captured bodies must not run as the UI origin;
+	// only raster images are shown inline, and others are given as plain downloads
+	contentType, _, _ := mime.ParseMediaType(body.Type())
+	if !inlineImageTypes[contentType] {
+		contentType = "application/octet-stream"
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(body.Data)
+}
+
+// image types safe to be shown inline in the UI
+var inlineImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+}
+
+// GET /api/events : session updates in Server-Sent Events
+func webUIEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := proxy.Subscribe()
+	defer proxy.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case rec := <-ch:
+			b, e := json.Marshal(rec)
+			if e != nil {
+				continue
+			}
+			if _, e = fmt.Fprintf(w, "data: %s\n\n", b); e != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// GET /files/{name} : download a saved body file
+// GET /files/{route}/{name} : download a saved body file of a routed session
+func webUIFile(w http.ResponseWriter, r *http.Request) {
+	route, name := path.Split(strings.TrimPrefix(r.URL.Path, "/files/"))
+	route = strings.TrimSuffix(route, "/")
+	// only the body files in the capture directory and the directories of the routes
+	if strings.Contains(route, "/") || !bodyFileName.MatchString(name) || !filepath.IsLocal(filepath.Join(route, name)) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeFile(w, r, filepath.Join(captureDir, route, name))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w).Encode(v)
+	if e != nil && verbose {
+		fmt.Printf("web UI: %v\n", e)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWebUIFile(t *testing.T) {
+	defer func(dir string) { captureDir = dir }(captureDir)
+	captureDir = t.TempDir()
+	os.Mkdir(filepath.Join(captureDir, "lab"), 0755)
+	for _, name := range []string{"000001_b_index.html", "lab/000002_b_logo.png", "lab/log.txt"} {
+		os.WriteFile(filepath.Join(captureDir, name), []byte(name), 0644)
+	}
+
+	for url, found := range map[string]bool{
+		"/files/000001_b_index.html":        true,
+		"/files/lab/000002_b_logo.png":      true,
+		"/files/000002_b_logo.png":          false,
+		"/files/lab/log.txt":                false,
+		"/files/../lab/000002_b_logo.png":   false,
+		"/files/lab/x/000002_b_logo.png":    false,
+		"/files/..%2Flab/000002_b_logo.png": false,
+	} {
+		w := httptest.NewRecorder()
+		webUIFile(w, httptest.NewRequest("GET", url, nil))
+		if (w.Code == 200) != found {
+			t.Errorf("%s: %d", url, w.Code)
+		}
+	}
+}
+
+func TestWebUIHost(t *testing.T) {
+	defer func(addr string) { uiListenAddress = addr }(uiListenAddress)
+	uiListenAddress = "192.168.1.2:38081"
+	if prepareWebUI() == nil {
+		t.Errorf("a non-loopback address accepted")
+	}
+	uiListenAddress = "localhost:38081"
+	if err := prepareWebUI(); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newWebUIHandler()
+	for host, ok := range map[string]bool{
+		"localhost:38081":    true,
+		"127.0.0.1:38081":    true,
+		"[::1]:38081":        true,
+		"evil.example:38081": false,
+		"localhost:80":       false,
+		"localhost":          false,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if (w.Code == 200) != ok {
+			t.Errorf("%s: %d", host, w.Code)
+		}
+	}
+}